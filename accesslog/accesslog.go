@@ -0,0 +1,247 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"github.com/brandnetworks/tcpproxy/proxy"
+)
+
+// DefaultTemplate reads like an HAProxy TCP log line
+const DefaultTemplate = "%ci:%cp [%t] %ft %b %si:%sp %Tt %U %B %ts %err"
+
+// The HAProxy style variables of a template, longer ones first so %sp isn't read as %s
+var variables = []string{"%err", "%ID", "%Tt", "%ci", "%cp", "%ft", "%si", "%sp", "%ts", "%t", "%b", "%U", "%B"}
+
+// The JSON line written for each session
+type entry struct {
+	Time       time.Time `json:"time"`
+	Session    string    `json:"session"`
+	Client     string    `json:"client"`
+	Route      string    `json:"route"`
+	Local      string    `json:"local"`
+	Upstream   string    `json:"upstream,omitempty"`
+	Start      time.Time `json:"start"`
+	DurationMs int64     `json:"duration_ms"`
+	BytesUp    int64     `json:"bytes_up"`
+	BytesDown  int64     `json:"bytes_down"`
+	Reason     string    `json:"reason"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// CreateAccessLog writes a line per session to path, or to stdout when path is "-". The format is
+// either "json" or a template of HAProxy style variables, see DefaultTemplate.
+func CreateAccessLog(path string, format string) (*AccessLog, error) {
+	accessLog := &AccessLog{path: path}
+
+	if format != "json" {
+		parts, err := parseTemplate(format)
+
+		if err != nil {
+			return nil, err
+		}
+
+		accessLog.template = parts
+	}
+
+	if path == "-" {
+		accessLog.out = os.Stdout
+		return accessLog, nil
+	}
+
+	if err := accessLog.Reopen(); err != nil {
+		return nil, err
+	}
+
+	return accessLog, nil
+}
+
+type AccessLog struct {
+	path     string
+	template []string
+
+	lock sync.Mutex
+	out  io.Writer
+	file *os.File
+}
+
+// parseTemplate splits a template into literal text and variables.
+func parseTemplate(template string) ([]string, error) {
+	parts := make([]string, 0)
+	literal := ""
+
+	for i := 0; i < len(template); {
+		if template[i] != '%' {
+			literal += template[i:i + 1]
+			i++
+			continue
+		}
+
+		if strings.HasPrefix(template[i:], "%%") {
+			literal += "%"
+			i += 2
+			continue
+		}
+
+		variable := ""
+
+		for _, candidate := range variables {
+			if strings.HasPrefix(template[i:], candidate) {
+				variable = candidate
+				break
+			}
+		}
+
+		if variable == "" {
+			return nil, fmt.Errorf("Unknown variable at '%s' in the access log format", template[i:])
+		}
+
+		if literal != "" {
+			parts = append(parts, literal)
+			literal = ""
+		}
+
+		parts = append(parts, variable)
+		i += len(variable)
+	}
+
+	if literal != "" {
+		parts = append(parts, literal)
+	}
+
+	return parts, nil
+}
+
+// Reopen closes the file and opens it again, so logrotate can move it out of the way.
+func (a *AccessLog) Reopen() error {
+	if a.path == "-" {
+		return nil
+	}
+
+	file, err := os.OpenFile(a.path, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0640)
+
+	if err != nil {
+		return err
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.file != nil {
+		a.file.Close()
+	}
+
+	a.file = file
+	a.out = file
+
+	return nil
+}
+
+func (a *AccessLog) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.file == nil {
+		return nil
+	}
+
+	return a.file.Close()
+}
+
+// Log writes the entry of a closed session, it is meant to be subscribed to the proxy's events.
+func (a *AccessLog) Log(event proxy.Event) {
+	if event.Type != proxy.SessionClosed {
+		return
+	}
+
+	var line string
+
+	if a.template == nil {
+		out, _ := json.Marshal(entry{
+			Time:       event.Time,
+			Session:    event.Session,
+			Client:     event.Client,
+			Route:      event.Route,
+			Local:      event.Local,
+			Upstream:   event.Target,
+			Start:      event.Time.Add(-event.Duration),
+			DurationMs: event.Duration.Milliseconds(),
+			BytesUp:    event.Received,
+			BytesDown:  event.Sent,
+			Reason:     event.Reason,
+			Error:      event.Error,
+		})
+
+		line = string(out)
+	} else {
+		line = a.format(event)
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	fmt.Fprintln(a.out, line)
+}
+
+func (a *AccessLog) format(event proxy.Event) string {
+	clientIP, clientPort := splitAddress(event.Client)
+	upstreamIP, upstreamPort := splitAddress(event.Target)
+
+	var line strings.Builder
+
+	for _, part := range a.template {
+		switch part {
+		case "%ci":
+			line.WriteString(clientIP)
+		case "%cp":
+			line.WriteString(clientPort)
+		case "%t":
+			line.WriteString(event.Time.Add(-event.Duration).Format("02/Jan/2006:15:04:05.000"))
+		case "%ft":
+			line.WriteString(event.Local)
+		case "%b":
+			line.WriteString(event.Route)
+		case "%si":
+			line.WriteString(upstreamIP)
+		case "%sp":
+			line.WriteString(upstreamPort)
+		case "%Tt":
+			line.WriteString(strconv.FormatInt(event.Duration.Milliseconds(), 10))
+		case "%U":
+			line.WriteString(strconv.FormatInt(event.Received, 10))
+		case "%B":
+			line.WriteString(strconv.FormatInt(event.Sent, 10))
+		case "%ts":
+			line.WriteString(event.Reason)
+		case "%ID":
+			line.WriteString(event.Session)
+		case "%err":
+			if event.Error == "" {
+				line.WriteString("-")
+			} else {
+				line.WriteString(strconv.Quote(event.Error))
+			}
+		default:
+			line.WriteString(part)
+		}
+	}
+
+	return line.String()
+}
+
+// Like HAProxy, missing values are logged as "-"
+func splitAddress(address string) (string, string) {
+	host, port, err := net.SplitHostPort(address)
+
+	if err != nil {
+		return "-", "-"
+	}
+
+	return host, port
+}
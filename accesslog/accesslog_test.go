@@ -0,0 +1,103 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"github.com/brandnetworks/tcpproxy/proxy"
+	"github.com/stretchr/testify/assert"
+)
+
+var closed = proxy.Event{
+	Type:     proxy.SessionClosed,
+	Time:     time.Date(2026, 3, 14, 9, 26, 53, 589000000, time.UTC),
+	Route:    "8002:db.example.com:5432",
+	Local:    ":8002",
+	Session:  "5f2a9c",
+	Client:   "10.0.0.7:51234",
+	Target:   "10.0.1.2:5432",
+	Sent:     2048,
+	Received: 512,
+	Duration: 1500 * time.Millisecond,
+	Reason:   proxy.ReasonClientClose,
+}
+
+func TestTemplate(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "accesslog")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "access.log")
+	accessLog, err := CreateAccessLog(path, DefaultTemplate)
+	assert.Nil(t, err)
+	defer accessLog.Close()
+
+	accessLog.Log(closed)
+
+	failed := proxy.Event{Type: proxy.SessionClosed, Time: closed.Time, Route: closed.Route, Local: ":8002", Client: "10.0.0.7:51235", Reason: proxy.ReasonDialFailed, Error: "connection refused"}
+	accessLog.Log(failed)
+
+	// Only closed sessions are logged
+	accessLog.Log(proxy.Event{Type: proxy.SessionOpened})
+
+	out, _ := ioutil.ReadFile(path)
+
+	assert.Equal(t, []string{
+		`10.0.0.7:51234 [14/Mar/2026:09:26:52.089] :8002 8002:db.example.com:5432 10.0.1.2:5432 1500 512 2048 client_close -`,
+		`10.0.0.7:51235 [14/Mar/2026:09:26:53.589] :8002 8002:db.example.com:5432 -:- 0 0 0 dial_failed "connection refused"`,
+	}, strings.Split(strings.TrimSpace(string(out)), "\n"))
+
+	_, err = CreateAccessLog(path, "%ci %nope")
+	assert.NotNil(t, err)
+}
+
+func TestJSON(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "accesslog")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "access.log")
+	accessLog, err := CreateAccessLog(path, "json")
+	assert.Nil(t, err)
+	defer accessLog.Close()
+
+	accessLog.Log(closed)
+
+	out, _ := ioutil.ReadFile(path)
+
+	var logged map[string]interface{}
+	assert.Nil(t, json.Unmarshal(out, &logged))
+	assert.Equal(t, "10.0.0.7:51234", logged["client"])
+	assert.Equal(t, "10.0.1.2:5432", logged["upstream"])
+	assert.Equal(t, "2026-03-14T09:26:52.089Z", logged["start"])
+	assert.Equal(t, float64(1500), logged["duration_ms"])
+	assert.Equal(t, float64(512), logged["bytes_up"])
+	assert.Equal(t, float64(2048), logged["bytes_down"])
+	assert.Equal(t, "client_close", logged["reason"])
+}
+
+func TestReopen(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "accesslog")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "access.log")
+	accessLog, err := CreateAccessLog(path, "%ID %ts")
+	assert.Nil(t, err)
+	defer accessLog.Close()
+
+	accessLog.Log(closed)
+
+	// As logrotate does, move the file away and then ask for it to be reopened
+	assert.Nil(t, os.Rename(path, path + ".1"))
+	accessLog.Log(closed)
+	assert.Nil(t, accessLog.Reopen())
+	accessLog.Log(closed)
+
+	rotated, _ := ioutil.ReadFile(path + ".1")
+	current, _ := ioutil.ReadFile(path)
+
+	assert.Equal(t, "5f2a9c client_close\n5f2a9c client_close\n", string(rotated))
+	assert.Equal(t, "5f2a9c client_close\n", string(current))
+}
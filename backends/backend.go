@@ -1,15 +1,85 @@
 package backends
 import (
 
+	"context"
 	"fmt"
+	"net"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type ConnectionConfig struct {
 	Name          string
-	LocalAddress  string   "local_address"
-	RemoteAddress string   "remote_address"
+	LocalAddress  string
+	RemoteAddress string
 	Url           string
+
+	// Optional attributes, the zero values keep the plain srcPort:destHost:destPort behaviour
+	Targets       []Target
+	DialTimeout   time.Duration
+	IdleTimeout   time.Duration
+	TLS           *TLSConfig
+	AllowedCIDRs  []string
+	Disabled      bool
+	Description   string
+	Owner         string
+
+	// Ends the sessions of the connection when its upstream changes under the same url, for primaries
+	// whose old node stops taking writes after a failover
+	EndSessionsOnRetarget bool
+
+	// Why a stored configuration couldn't be parsed, only ListProxyConfigurations returns these and
+	// only their Url is set
+	Invalid       string
+}
+
+// An upstream for a connection, lower priorities are preferred and the weight
+// balances between targets of the same priority.
+type Target struct {
+	Address  string
+	Priority int
+	Weight   int
+}
+
+// TLS used when dialing the upstream, a nil *TLSConfig means plain TCP.
+type TLSConfig struct {
+	ServerName         string
+	InsecureSkipVerify bool
+	CAFile             string
+}
+
+// Upstreams returns the targets of the connection, falling back to RemoteAddress when none are set.
+func (c ConnectionConfig) Upstreams() []Target {
+	if len(c.Targets) > 0 {
+		return c.Targets
+	}
+
+	return []Target{{Address: c.RemoteAddress, Weight: 1}}
+}
+
+func (c ConnectionConfig) Validate() error {
+	for _, target := range c.Upstreams() {
+		if _, _, err := net.SplitHostPort(target.Address); err != nil {
+			return fmt.Errorf("Invalid target '%s' for connection '%s': %v", target.Address, c.Url, err)
+		}
+
+		if target.Weight < 0 {
+			return fmt.Errorf("Invalid weight %d for target '%s' of connection '%s'", target.Weight, target.Address, c.Url)
+		}
+	}
+
+	for _, cidr := range c.AllowedCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("Invalid CIDR '%s' for connection '%s': %v", cidr, c.Url, err)
+		}
+	}
+
+	if c.DialTimeout < 0 || c.IdleTimeout < 0 {
+		return fmt.Errorf("Timeouts for connection '%s' must not be negative", c.Url)
+	}
+
+	return nil
 }
 
 type ReadWrite interface {
@@ -18,11 +88,76 @@ type ReadWrite interface {
 	GetProxyConfigurations() ([]ConnectionConfig, error)
 }
 
+// Backends whose stored configurations can be listed, including disabled ones, and toggled
+type Manageable interface {
+	ReadWrite
+	ListProxyConfigurations() ([]ConnectionConfig, error)
+	SetProxyConfigurationEnabled(proxy_configuration string, enabled bool) error
+}
+
 type ReadOnly interface {
 	GetProxyConfigurations() ([]ConnectionConfig, error)
 	IsPollable() bool
 }
 
+// Backends whose polls take a context, so the calls they make show up in the trace of the poll
+type ContextReadOnly interface {
+	ReadOnly
+	GetProxyConfigurationsWithContext(ctx context.Context) ([]ConnectionConfig, error)
+}
+
+// GetProxyConfigurationsWithContext polls the backend, passing ctx along when it takes one.
+func GetProxyConfigurationsWithContext(ctx context.Context, backend ReadOnly) ([]ConnectionConfig, error) {
+	if contextual, ok := backend.(ContextReadOnly); ok {
+		return contextual.GetProxyConfigurationsWithContext(ctx)
+	}
+
+	return backend.GetProxyConfigurations()
+}
+
+// Backends whose source is only read again when asked to, like a connections file, see Proxy.Reload
+type Reloadable interface {
+	// Reload reads the source again, keeping the previous configurations when that fails
+	Reload() error
+}
+
+// Backends which notice changes themselves, so they are applied without waiting for the next poll
+type Watchable interface {
+	// Changes receives a value whenever GetProxyConfigurations has something new to return
+	Changes() <-chan struct{}
+}
+
+// Backends holding on to something between polls, like the watches of a blocking query, released once
+// the proxy stops. Closing more than once is harmless.
+type Closeable interface {
+	Close() error
+}
+
+// Close releases the backend when it holds on to anything between polls.
+func Close(backend ReadOnly) error {
+	if closeable, ok := backend.(Closeable); ok {
+		return closeable.Close()
+	}
+
+	return nil
+}
+
+// StaleError is returned by a poll which reached none of its sources, with the configurations it last fetched
+// from them. The poll failed all the same, the configurations are only as recent as Since.
+type StaleError struct {
+	Err         error
+	Connections []ConnectionConfig
+	Since       time.Time
+}
+
+func (e *StaleError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StaleError) Unwrap() error {
+	return e.Err
+}
+
 func ParseConnectionsParameter(connectionsArg string) ([]ConnectionConfig, error) {
 	if len(connectionsArg) == 0 {
 		return nil, fmt.Errorf("Connection must not be empty")
@@ -35,10 +170,10 @@ func ParseConnectionsParameter(connectionsArg string) ([]ConnectionConfig, error
 		config, err := ParseConnection(connections[i])
 
 		if err != nil {
-			fmt.Errorf("Error parsing connection %s", connections[i])
-		} else {
-			connectionsConfig[i] = *config
+			return nil, fmt.Errorf("Error parsing connection %s: %v", connections[i], err)
 		}
+
+		connectionsConfig[i] = *config
 	}
 
 	return connectionsConfig, nil
@@ -47,7 +182,17 @@ func ParseConnectionsParameter(connectionsArg string) ([]ConnectionConfig, error
 func ParseConnection(connection string) (*ConnectionConfig, error) {
 	connectionParts := strings.Split(connection, ":")
 	if len(connectionParts) != 3 {
-		return nil, fmt.Errorf("A connection must have three parts: srcPort:destHost:destPort '", connection, "'")
+		return nil, fmt.Errorf("A connection must have three parts: srcPort:destHost:destPort '%s'", connection)
+	}
+
+	if connectionParts[1] == "" {
+		return nil, fmt.Errorf("A connection must have a destHost '%s'", connection)
+	}
+
+	for _, port := range []string{connectionParts[0], connectionParts[2]} {
+		if number, err := strconv.Atoi(port); err != nil || number < 1 || number > 65535 {
+			return nil, fmt.Errorf("Invalid port '%s' in connection '%s'", port, connection)
+		}
 	}
 
 	config := ConnectionConfig{
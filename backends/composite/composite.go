@@ -0,0 +1,242 @@
+package composite
+
+import (
+	"context"
+	"github.com/brandnetworks/tcpproxy/backends"
+	"net"
+	"sort"
+	"sync"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// A backend merged into the composite, a higher priority wins when two sources want the same local port.
+type Source struct {
+	Name     string
+	Priority int
+	Backend  backends.ReadOnly
+}
+
+func CreateCompositeBackend(logger *slog.Logger, sources []Source) *CompositeBackend {
+	return &CompositeBackend{
+		logger: logger,
+		sources: sources,
+		lastKnownGood: make(map[string][]backends.ConnectionConfig),
+		changes: make(chan struct{}, 1),
+	}
+}
+
+// CreateManageableCompositeBackend is CreateCompositeBackend managing routes through the one source which stores
+// them, if any, so the routes endpoints and command keep working. More than one such source is refused, as
+// it couldn't be told which of them a new route belongs to.
+func CreateManageableCompositeBackend(logger *slog.Logger, sources []Source) (backends.ReadOnly, error) {
+	backend := CreateCompositeBackend(logger, sources)
+
+	var store *Source
+
+	for i := range sources {
+		if _, ok := sources[i].Backend.(backends.Manageable); !ok {
+			continue
+		}
+
+		if store != nil {
+			return nil, fmt.Errorf("Only one backend may store routes, both %s and %s do", store.Name, sources[i].Name)
+		}
+
+		store = &sources[i]
+	}
+
+	if store == nil {
+		return backend, nil
+	}
+
+	return &ManageableCompositeBackend{CompositeBackend: backend, store: store.Backend.(backends.Manageable)}, nil
+}
+
+// CompositeBackend merges the routes of several backends. A failing source contributes the routes of
+// its last successful poll, so it doesn't take down the routes of the others. When they all fail the poll
+// does too, with a *backends.StaleError carrying those routes.
+type CompositeBackend struct {
+	logger *slog.Logger
+	sources []Source
+
+	lock sync.Mutex
+	lastKnownGood map[string][]backends.ConnectionConfig
+
+	// When a source last answered
+	fetched time.Time
+
+	watchOnce sync.Once
+	changes chan struct{}
+}
+
+// The port a local address listens on, which is what two sources can't share
+func localPort(connection backends.ConnectionConfig) string {
+	_, port, err := net.SplitHostPort(connection.LocalAddress)
+
+	if err != nil {
+		return connection.LocalAddress
+	}
+
+	return port
+}
+
+func (d *CompositeBackend) GetProxyConfigurations() ([]backends.ConnectionConfig, error) {
+	return d.GetProxyConfigurationsWithContext(context.Background())
+}
+
+func (d *CompositeBackend) GetProxyConfigurationsWithContext(ctx context.Context) ([]backends.ConnectionConfig, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	// Highest priority first, keeping the given order between equal ones
+	sources := make([]Source, len(d.sources))
+	copy(sources, d.sources)
+
+	sort.SliceStable(sources, func(i, j int) bool {
+		return sources[i].Priority > sources[j].Priority
+	})
+
+	connections := make([]backends.ConnectionConfig, 0)
+	owners := make(map[string]string)
+	failed := 0
+
+	for _, source := range sources {
+		sourceConnections, err := backends.GetProxyConfigurationsWithContext(ctx, source.Backend)
+
+		if err != nil {
+			failed++
+
+			previous, ok := d.lastKnownGood[source.Name]
+
+			if !ok {
+				d.logger.Error("Error fetching routes, none fetched yet", "source", source.Name, "error", err)
+				continue
+			}
+
+			d.logger.Warn("Error fetching routes, keeping the last fetched", "source", source.Name, "routes", len(previous), "error", err)
+			sourceConnections = previous
+		} else {
+			d.lastKnownGood[source.Name] = sourceConnections
+		}
+
+		for _, connection := range sourceConnections {
+			port := localPort(connection)
+
+			if owner, ok := owners[port]; ok {
+				d.logger.Warn("Ignoring route, its local port is already used", "source", source.Name, "route", connection.Url, "port", port, "used_by", owner)
+				continue
+			}
+
+			owners[port] = source.Name + " " + connection.Url
+			connections = append(connections, connection)
+		}
+	}
+
+	if failed == len(sources) {
+		err := fmt.Errorf("All %d sources failed", len(sources))
+
+		if len(d.lastKnownGood) == 0 {
+			return nil, err
+		}
+
+		return nil, &backends.StaleError{Err: err, Connections: connections, Since: d.fetched}
+	}
+
+	d.fetched = time.Now().UTC()
+
+	d.logger.Debug("Merged routes", "routes", len(connections), "sources", len(sources), "failed", failed)
+
+	return connections, nil
+}
+
+// Changes forwards the changes of any watchable source.
+func (d *CompositeBackend) Changes() <-chan struct{} {
+	d.watchOnce.Do(func() {
+		for _, source := range d.sources {
+			watchable, ok := source.Backend.(backends.Watchable)
+
+			if !ok {
+				continue
+			}
+
+			go func(changes <-chan struct{}) {
+				for range changes {
+					select {
+					case d.changes <- struct{}{}:
+					default:
+					}
+				}
+			}(watchable.Changes())
+		}
+	})
+
+	return d.changes
+}
+
+// Reload reloads the sources that can be, each keeping its previous routes when that fails.
+func (d *CompositeBackend) Reload() error {
+	var reloadErr error
+
+	for _, source := range d.sources {
+		reloadable, ok := source.Backend.(backends.Reloadable)
+
+		if !ok {
+			continue
+		}
+
+		if err := reloadable.Reload(); err != nil && reloadErr == nil {
+			reloadErr = fmt.Errorf("Error reloading %s: %v", source.Name, err)
+		}
+	}
+
+	return reloadErr
+}
+
+// Close closes the sources that hold on to anything between polls.
+func (d *CompositeBackend) Close() error {
+	var closeErr error
+
+	for _, source := range d.sources {
+		if err := backends.Close(source.Backend); err != nil && closeErr == nil {
+			closeErr = fmt.Errorf("Error closing %s: %v", source.Name, err)
+		}
+	}
+
+	return closeErr
+}
+
+// ManageableCompositeBackend polls the merged routes of a composite, while listing and changing the stored routes
+// of its one source storing them. Routes it adds are merged with the others on the next poll.
+type ManageableCompositeBackend struct {
+	*CompositeBackend
+	store backends.Manageable
+}
+
+func (d *ManageableCompositeBackend) CreateProxyConfiguration(proxy_configuration string) error {
+	return d.store.CreateProxyConfiguration(proxy_configuration)
+}
+
+func (d *ManageableCompositeBackend) DeleteProxyConfiguration(proxy_configuration string) error {
+	return d.store.DeleteProxyConfiguration(proxy_configuration)
+}
+
+func (d *ManageableCompositeBackend) SetProxyConfigurationEnabled(proxy_configuration string, enabled bool) error {
+	return d.store.SetProxyConfigurationEnabled(proxy_configuration, enabled)
+}
+
+// ListProxyConfigurations only lists the routes of the source storing them, which are the ones that can be changed.
+func (d *ManageableCompositeBackend) ListProxyConfigurations() ([]backends.ConnectionConfig, error) {
+	return d.store.ListProxyConfigurations()
+}
+
+func (d *CompositeBackend) IsPollable() bool {
+	for _, source := range d.sources {
+		if source.Backend.IsPollable() {
+			return true
+		}
+	}
+
+	return false
+}
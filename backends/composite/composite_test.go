@@ -0,0 +1,170 @@
+package composite
+
+import (
+	"fmt"
+	"log/slog"
+	"testing"
+	"github.com/brandnetworks/tcpproxy/backends"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeBackend struct {
+	connections string
+	err         error
+	pollable    bool
+}
+
+func (b *fakeBackend) GetProxyConfigurations() ([]backends.ConnectionConfig, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	return backends.ParseConnectionsParameter(b.connections)
+}
+
+func (b *fakeBackend) IsPollable() bool {
+	return b.pollable
+}
+
+// Stores the routes it returns, like the dynamodb backend
+type storingBackend struct {
+	fakeBackend
+	created []string
+}
+
+func (b *storingBackend) CreateProxyConfiguration(proxy_configuration string) error {
+	b.created = append(b.created, proxy_configuration)
+	return nil
+}
+
+func (b *storingBackend) DeleteProxyConfiguration(proxy_configuration string) error {
+	return nil
+}
+
+func (b *storingBackend) SetProxyConfigurationEnabled(proxy_configuration string, enabled bool) error {
+	return nil
+}
+
+func (b *storingBackend) ListProxyConfigurations() ([]backends.ConnectionConfig, error) {
+	return b.GetProxyConfigurations()
+}
+
+func urls(connections []backends.ConnectionConfig) []string {
+	found := make([]string, len(connections))
+
+	for i := range connections {
+		found[i] = connections[i].Url
+	}
+
+	return found
+}
+
+func TestMergeWithPriorities(t *testing.T) {
+	backend := CreateCompositeBackend(slog.New(slog.DiscardHandler), []Source{
+		{Name: "static", Priority: 1, Backend: &fakeBackend{connections: "8002:static.example.com:5432,8003:static.example.com:5433"}},
+		{Name: "dynamodb", Priority: 2, Backend: &fakeBackend{connections: "8002:dynamo.example.com:5432,8004:dynamo.example.com:5434", pollable: true}},
+	})
+
+	connections, err := backend.GetProxyConfigurations()
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"8002:dynamo.example.com:5432", "8004:dynamo.example.com:5434", "8003:static.example.com:5433"}, urls(connections))
+	assert.True(t, backend.IsPollable())
+}
+
+func TestFailingSourceKeepsLastKnownGood(t *testing.T) {
+	static := &fakeBackend{connections: "8002:static.example.com:5432"}
+	dynamo := &fakeBackend{connections: "8004:dynamo.example.com:5434"}
+
+	backend := CreateCompositeBackend(slog.New(slog.DiscardHandler), []Source{
+		{Name: "static", Backend: static},
+		{Name: "dynamodb", Backend: dynamo},
+	})
+
+	_, err := backend.GetProxyConfigurations()
+	assert.Nil(t, err)
+
+	dynamo.err = fmt.Errorf("AccessDeniedException")
+	static.connections = "8002:static.example.com:5432,8003:static.example.com:5433"
+
+	connections, err := backend.GetProxyConfigurations()
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"8002:static.example.com:5432", "8003:static.example.com:5433", "8004:dynamo.example.com:5434"}, urls(connections))
+	assert.False(t, backend.IsPollable())
+}
+
+func TestAllSourcesFailing(t *testing.T) {
+	backend := CreateCompositeBackend(slog.New(slog.DiscardHandler), []Source{
+		{Name: "dynamodb", Backend: &fakeBackend{err: fmt.Errorf("AccessDeniedException")}},
+		{Name: "elasticache", Backend: &fakeBackend{err: fmt.Errorf("Throttling")}},
+	})
+
+	_, err := backend.GetProxyConfigurations()
+
+	assert.NotNil(t, err)
+}
+
+func TestAllSourcesFailingAfterFetching(t *testing.T) {
+	static := &fakeBackend{connections: "8002:static.example.com:5432"}
+	dynamo := &fakeBackend{connections: "8004:dynamo.example.com:5434"}
+
+	backend := CreateCompositeBackend(slog.New(slog.DiscardHandler), []Source{
+		{Name: "static", Backend: static},
+		{Name: "dynamodb", Backend: dynamo},
+	})
+
+	_, err := backend.GetProxyConfigurations()
+	assert.Nil(t, err)
+
+	static.err = fmt.Errorf("Throttling")
+	dynamo.err = fmt.Errorf("AccessDeniedException")
+
+	// The poll fails, carrying the routes last fetched rather than passing them off as fresh
+	_, err = backend.GetProxyConfigurations()
+
+	stale, ok := err.(*backends.StaleError)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"8002:static.example.com:5432", "8004:dynamo.example.com:5434"}, urls(stale.Connections))
+	assert.False(t, stale.Since.IsZero())
+}
+
+func TestManageThroughStoringSource(t *testing.T) {
+	dynamo := &storingBackend{fakeBackend: fakeBackend{connections: "8004:dynamo.example.com:5434"}}
+
+	backend, err := CreateManageableCompositeBackend(slog.New(slog.DiscardHandler), []Source{
+		{Name: "static", Backend: &fakeBackend{connections: "8002:static.example.com:5432"}},
+		{Name: "dynamodb", Backend: dynamo},
+	})
+	assert.Nil(t, err)
+
+	manageable, ok := backend.(backends.Manageable)
+	assert.True(t, ok)
+
+	// Polls see every source, managing only sees the one storing the routes
+	connections, err := manageable.GetProxyConfigurations()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"8002:static.example.com:5432", "8004:dynamo.example.com:5434"}, urls(connections))
+
+	stored, err := manageable.ListProxyConfigurations()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"8004:dynamo.example.com:5434"}, urls(stored))
+
+	assert.Nil(t, manageable.CreateProxyConfiguration("8005:dynamo.example.com:5435"))
+	assert.Equal(t, []string{"8005:dynamo.example.com:5435"}, dynamo.created)
+
+	// Without a source storing routes it stays read only
+	backend, err = CreateManageableCompositeBackend(slog.New(slog.DiscardHandler), []Source{
+		{Name: "static", Backend: &fakeBackend{connections: "8002:static.example.com:5432"}},
+	})
+	assert.Nil(t, err)
+
+	_, ok = backend.(backends.ReadWrite)
+	assert.False(t, ok)
+
+	_, err = CreateManageableCompositeBackend(slog.New(slog.DiscardHandler), []Source{
+		{Name: "dynamodb", Backend: dynamo},
+		{Name: "other", Backend: &storingBackend{}},
+	})
+	assert.NotNil(t, err)
+}
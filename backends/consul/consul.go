@@ -0,0 +1,308 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/brandnetworks/tcpproxy/backends"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"fmt"
+	"log/slog"
+)
+
+const (
+	// How long Consul holds a blocking query open when nothing changes
+	waitTime = 5 * time.Minute
+	minRetryDelay = 1 * time.Second
+	maxRetryDelay = 1 * time.Minute
+)
+
+// A Consul service whose healthy instances are proxied on the local port.
+type Service struct {
+	Name      string
+	LocalPort int
+}
+
+// ParseServices parses a comma separated list of localPort:service pairs.
+func ParseServices(servicesArg string) ([]Service, error) {
+	if len(servicesArg) == 0 {
+		return nil, fmt.Errorf("Services must not be empty")
+	}
+
+	serviceArgs := strings.Split(servicesArg, ",")
+	services := make([]Service, len(serviceArgs))
+
+	for i, serviceArg := range serviceArgs {
+		parts := strings.Split(serviceArg, ":")
+
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("A service must have two parts: localPort:service '%s'", serviceArg)
+		}
+
+		port, err := strconv.Atoi(parts[0])
+
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("Invalid local port '%s' for service %s", parts[0], parts[1])
+		}
+
+		services[i] = Service{Name: parts[1], LocalPort: port}
+	}
+
+	return services, nil
+}
+
+// CreateConsulBackend reads the passing instances of the services from the Consul agent or server at address.
+// The token and datacenter are optional.
+func CreateConsulBackend(logger *slog.Logger, address string, token string, datacenter string, services []Service) *ConsulBackend {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &ConsulBackend{
+		logger: logger,
+		address: strings.TrimSuffix(address, "/"),
+		token: token,
+		datacenter: datacenter,
+		services: services,
+		client: &http.Client{Timeout: waitTime + waitTime / 16 + 30 * time.Second},
+		targets: make(map[string][]backends.Target),
+		changes: make(chan struct{}, 1),
+		ctx: ctx,
+		cancel: cancel,
+	}
+}
+
+// ConsulBackend keeps a blocking query open per service, so changes are pushed through
+// Changes as soon as Consul sees them rather than on the next poll.
+type ConsulBackend struct {
+	logger *slog.Logger
+	address string
+	token string
+	datacenter string
+	services []Service
+	client *http.Client
+
+	lock sync.Mutex
+	watching bool
+	targets map[string][]backends.Target
+
+	changes chan struct{}
+	ctx context.Context
+	cancel context.CancelFunc
+}
+
+type healthEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+		Weights struct {
+			Passing int
+		}
+	}
+}
+
+func (d *ConsulBackend) GetProxyConfigurations() ([]backends.ConnectionConfig, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	// The first call fetches synchronously, so it can fail, and then leaves the rest to the watches
+	if !d.watching {
+		indexes := make([]uint64, len(d.services))
+
+		for i, service := range d.services {
+			targets, index, err := d.query(d.ctx, service.Name, 0)
+
+			if err != nil {
+				d.logger.Error("Error querying Consul", "service", service.Name, "error", err)
+				return nil, err
+			}
+
+			d.targets[service.Name] = targets
+			indexes[i] = index
+		}
+
+		for i, service := range d.services {
+			go d.watch(service.Name, indexes[i])
+		}
+
+		d.watching = true
+	}
+
+	connections := make([]backends.ConnectionConfig, 0, len(d.services))
+
+	for _, service := range d.services {
+		targets := d.targets[service.Name]
+
+		if len(targets) == 0 {
+			continue
+		}
+
+		localPort := strconv.Itoa(service.LocalPort)
+
+		// The url names the service rather than its instances, so they change in place
+		connections = append(connections, backends.ConnectionConfig{
+			Name: service.Name,
+			LocalAddress: ":" + localPort,
+			RemoteAddress: targets[0].Address,
+			Targets: targets,
+			Url: localPort + ":" + service.Name + ":consul",
+		})
+	}
+
+	return connections, nil
+}
+
+func (d *ConsulBackend) Changes() <-chan struct{} {
+	return d.changes
+}
+
+// Close stops the blocking queries.
+func (d *ConsulBackend) Close() error {
+	d.cancel()
+	return nil
+}
+
+func (d *ConsulBackend) watch(service string, index uint64) {
+	retryDelay := minRetryDelay
+
+	for {
+		targets, newIndex, err := d.query(d.ctx, service, index)
+
+		select {
+		case <-d.ctx.Done():
+			return
+		default:
+		}
+
+		if err != nil {
+			d.logger.Warn("Error watching Consul", "service", service, "retry_in", retryDelay, "error", err)
+
+			// Waited out on a timer rather than a sleep, so Close doesn't have to wait for the retry
+			timer := time.NewTimer(retryDelay)
+
+			select {
+			case <-timer.C:
+			case <-d.ctx.Done():
+				timer.Stop()
+				return
+			}
+
+			if retryDelay *= 2; retryDelay > maxRetryDelay {
+				retryDelay = maxRetryDelay
+			}
+
+			continue
+		}
+
+		retryDelay = minRetryDelay
+
+		// An index going backwards means Consul's state was reset, so start over
+		if newIndex < index {
+			index = 0
+			continue
+		}
+
+		if newIndex == index {
+			continue
+		}
+
+		index = newIndex
+
+		d.logger.Debug("Consul index changed", "service", service, "index", index, "passing", len(targets))
+
+		d.lock.Lock()
+		d.targets[service] = targets
+		d.lock.Unlock()
+
+		select {
+		case d.changes <- struct{}{}:
+		default:
+			// A change is already pending, which picks this one up too
+		}
+	}
+}
+
+// query blocks until the service changes past index, or the wait time runs out.
+func (d *ConsulBackend) query(ctx context.Context, service string, index uint64) ([]backends.Target, uint64, error) {
+	params := url.Values{}
+	params.Set("passing", "1")
+
+	if index > 0 {
+		params.Set("index", strconv.FormatUint(index, 10))
+		params.Set("wait", fmt.Sprintf("%ds", int(waitTime.Seconds())))
+	}
+
+	if d.datacenter != "" {
+		params.Set("dc", d.datacenter)
+	}
+
+	request, err := http.NewRequest("GET", d.address + "/v1/health/service/" + url.PathEscape(service) + "?" + params.Encode(), nil)
+
+	if err != nil {
+		return nil, index, err
+	}
+
+	if d.token != "" {
+		request.Header.Set("X-Consul-Token", d.token)
+	}
+
+	response, err := d.client.Do(request.WithContext(ctx))
+
+	if err != nil {
+		return nil, index, err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, index, fmt.Errorf("Consul responded %s for %s", response.Status, service)
+	}
+
+	newIndex, err := strconv.ParseUint(response.Header.Get("X-Consul-Index"), 10, 64)
+
+	if err != nil {
+		return nil, index, fmt.Errorf("Consul responded without a valid X-Consul-Index for %s", service)
+	}
+
+	var entries []healthEntry
+
+	if err := json.NewDecoder(response.Body).Decode(&entries); err != nil {
+		return nil, index, err
+	}
+
+	targets := make([]backends.Target, 0, len(entries))
+
+	for _, entry := range entries {
+		address := entry.Service.Address
+
+		if address == "" {
+			address = entry.Node.Address
+		}
+
+		weight := entry.Service.Weights.Passing
+
+		if weight <= 0 {
+			weight = 1
+		}
+
+		targets = append(targets, backends.Target{Address: net.JoinHostPort(address, strconv.Itoa(entry.Service.Port)), Weight: weight})
+	}
+
+	// Consul doesn't guarantee an order, a stable one stops unchanged services looking changed
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].Address < targets[j].Address
+	})
+
+	return targets, newIndex, nil
+}
+
+func (b *ConsulBackend) IsPollable() bool {
+	return true
+}
@@ -0,0 +1,152 @@
+package consul
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+	"github.com/brandnetworks/tcpproxy/backends"
+	"github.com/stretchr/testify/assert"
+)
+
+// catalog is a stand in for Consul's health endpoint, holding blocking queries until the index moves on.
+type catalog struct {
+	sync.Mutex
+	index   uint64
+	entries []map[string]interface{}
+	changed chan struct{}
+}
+
+func (c *catalog) set(entries ...map[string]interface{}) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.index++
+	c.entries = entries
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *catalog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/health/service/postgres" || r.URL.Query().Get("passing") == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	c.Lock()
+	index, changed := c.index, c.changed
+	c.Unlock()
+
+	if requested, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64); requested == index {
+		select {
+		case <-changed:
+		case <-time.After(2 * time.Second):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(c.index, 10))
+	json.NewEncoder(w).Encode(c.entries)
+}
+
+func entry(nodeAddress string, serviceAddress string, port int) map[string]interface{} {
+	return map[string]interface{}{
+		"Node":    map[string]interface{}{"Address": nodeAddress},
+		"Service": map[string]interface{}{"Address": serviceAddress, "Port": port},
+	}
+}
+
+func TestParseServices(t *testing.T) {
+	services, err := ParseServices("5432:postgres,6379:redis")
+
+	assert.Nil(t, err)
+	assert.Equal(t, []Service{{Name: "postgres", LocalPort: 5432}, {Name: "redis", LocalPort: 6379}}, services)
+
+	_, err = ParseServices("postgres")
+	assert.NotNil(t, err)
+}
+
+func TestBlockingQueries(t *testing.T) {
+	stub := &catalog{changed: make(chan struct{})}
+	stub.set(entry("10.0.0.2", "", 5432), entry("10.0.0.1", "10.0.1.1", 5433))
+
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	backend := CreateConsulBackend(slog.New(slog.DiscardHandler), server.URL, "", "", []Service{{Name: "postgres", LocalPort: 15432}})
+	defer backend.Close()
+
+	connections, err := backend.GetProxyConfigurations()
+
+	assert.Nil(t, err)
+	assert.Len(t, connections, 1)
+	assert.Equal(t, ":15432", connections[0].LocalAddress)
+	assert.Equal(t, "15432:postgres:consul", connections[0].Url)
+	assert.Equal(t, []backends.Target{{Address: "10.0.0.2:5432", Weight: 1}, {Address: "10.0.1.1:5433", Weight: 1}}, connections[0].Upstreams())
+
+	// The change is pushed by the blocking query rather than waiting for a poll
+	stub.set(entry("10.0.0.3", "", 5432))
+
+	select {
+	case <-backend.Changes():
+	case <-time.After(time.Second):
+		t.Fatal("No change pushed")
+	}
+
+	connections, err = backend.GetProxyConfigurations()
+
+	assert.Nil(t, err)
+	assert.Equal(t, []backends.Target{{Address: "10.0.0.3:5432", Weight: 1}}, connections[0].Upstreams())
+
+	// No passing instances leaves nothing to proxy to
+	stub.set()
+	<-backend.Changes()
+
+	connections, err = backend.GetProxyConfigurations()
+
+	assert.Nil(t, err)
+	assert.Empty(t, connections)
+}
+
+func TestUnavailableCatalog(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	backend := CreateConsulBackend(slog.New(slog.DiscardHandler), server.URL, "", "", []Service{{Name: "postgres", LocalPort: 15432}})
+	defer backend.Close()
+
+	_, err := backend.GetProxyConfigurations()
+
+	assert.NotNil(t, err)
+}
+
+func TestCloseDuringRetry(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	backend := CreateConsulBackend(slog.New(slog.DiscardHandler), server.URL, "", "", []Service{{Name: "postgres", LocalPort: 15432}})
+
+	done := make(chan struct{})
+	go func() {
+		backend.watch("postgres", 0)
+		close(done)
+	}()
+
+	// The first query fails straight away, leaving the watch waiting to retry
+	time.Sleep(100 * time.Millisecond)
+	backend.Close()
+
+	select {
+	case <-done:
+	case <-time.After(minRetryDelay / 2):
+		t.Fatal("The watch kept waiting to retry after Close")
+	}
+}
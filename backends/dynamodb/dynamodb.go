@@ -1,12 +1,27 @@
 package dynamodb
 
 import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 	"github.com/brandnetworks/tcpproxy/backends"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// Looked up on every call, so the provider configured at startup applies
+func tracer() trace.Tracer {
+	return otel.Tracer("github.com/brandnetworks/tcpproxy/backends/dynamodb")
+}
+
 func createProxy(tablename string, proxy_name string, proxy_configuration string) *dynamodb.PutItemInput {
 	params := &dynamodb.PutItemInput{
 		Item: map[string]*dynamodb.AttributeValue{// Required
@@ -32,6 +47,28 @@ func deleteProxy(tablename string, proxy_name string, proxy_configuration string
 	return params
 }
 
+func setProxyEnabled(tablename string, proxy_name string, proxy_configuration string, enabled bool) *dynamodb.UpdateItemInput {
+	params := &dynamodb.UpdateItemInput{
+		Key: map[string]*dynamodb.AttributeValue{// Required
+			"proxy_name": {S: aws.String(proxy_name)},
+			"proxy_configuration": {S: aws.String(proxy_configuration)},
+		},
+		TableName: aws.String(tablename), // Required
+
+		// Without the condition an update on a missing key would create a new item
+		ConditionExpression: aws.String("attribute_exists(proxy_configuration)"),
+		UpdateExpression: aws.String("SET #enabled = :enabled"),
+		ExpressionAttributeNames: map[string]*string{
+			"#enabled": aws.String("enabled"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":enabled": {BOOL: aws.Bool(enabled)},
+		},
+	}
+
+	return params
+}
+
 func getProxiesWithName(tablename string, proxy_name string) *dynamodb.QueryInput {
 	params := &dynamodb.QueryInput{
 		TableName: aws.String(tablename),
@@ -46,12 +83,193 @@ func getProxiesWithName(tablename string, proxy_name string) *dynamodb.QueryInpu
 		// http://docs.aws.amazon.com/amazondynamodb/latest/developerguide/QueryAndScan.html#Pagination
 //		Limit: aws.Int64(100),
 
-		ProjectionExpression: aws.String("proxy_name, proxy_configuration"),
+		ExpressionAttributeNames: projectionNames(),
+		ProjectionExpression: aws.String(projectionExpression()),
 	}
 
 	return params
 }
 
+// Attributes read from an item, everything except proxy_name and proxy_configuration is optional
+var itemAttributes = []string{
+	"proxy_name",
+	"proxy_configuration",
+	"targets",
+	"dial_timeout",
+	"idle_timeout",
+	"tls",
+	"allowed_cidrs",
+	"enabled",
+	"description",
+	"owner",
+}
+
+// Attribute names are aliased as some of them, like owner, may clash with reserved words
+func projectionNames() map[string]*string {
+	names := make(map[string]*string, len(itemAttributes))
+
+	for _, attribute := range itemAttributes {
+		names["#" + attribute] = aws.String(attribute)
+	}
+
+	return names
+}
+
+func projectionExpression() string {
+	aliases := make([]string, len(itemAttributes))
+
+	for i, attribute := range itemAttributes {
+		aliases[i] = "#" + attribute
+	}
+
+	return strings.Join(aliases, ", ")
+}
+
+// parseItem builds a connection from the legacy proxy_configuration string and
+// overlays any of the optional typed attributes present on the item.
+func parseItem(item map[string]*dynamodb.AttributeValue) (*backends.ConnectionConfig, error) {
+	configuration, ok := item["proxy_configuration"]
+
+	if !ok || configuration.S == nil {
+		return nil, fmt.Errorf("Item is missing a proxy_configuration")
+	}
+
+	connection, err := backends.ParseConnection(*configuration.S)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if attribute, ok := item["targets"]; ok {
+		targets, err := stringList("targets", attribute)
+
+		if err != nil {
+			return nil, err
+		}
+
+		connection.Targets = make([]backends.Target, len(targets))
+
+		for i := range targets {
+			connection.Targets[i] = backends.Target{Address: targets[i], Weight: 1}
+		}
+	}
+
+	if attribute, ok := item["dial_timeout"]; ok {
+		if connection.DialTimeout, err = duration("dial_timeout", attribute); err != nil {
+			return nil, err
+		}
+	}
+
+	if attribute, ok := item["idle_timeout"]; ok {
+		if connection.IdleTimeout, err = duration("idle_timeout", attribute); err != nil {
+			return nil, err
+		}
+	}
+
+	if attribute, ok := item["tls"]; ok {
+		if connection.TLS, err = tlsConfig(attribute); err != nil {
+			return nil, err
+		}
+	}
+
+	if attribute, ok := item["allowed_cidrs"]; ok {
+		if connection.AllowedCIDRs, err = stringList("allowed_cidrs", attribute); err != nil {
+			return nil, err
+		}
+	}
+
+	if attribute, ok := item["enabled"]; ok {
+		if attribute.BOOL == nil {
+			return nil, fmt.Errorf("Attribute enabled of '%s' must be a boolean", connection.Url)
+		}
+
+		connection.Disabled = !*attribute.BOOL
+	}
+
+	if attribute, ok := item["description"]; ok && attribute.S != nil {
+		connection.Description = *attribute.S
+	}
+
+	if attribute, ok := item["owner"]; ok && attribute.S != nil {
+		connection.Owner = *attribute.S
+	}
+
+	return connection, connection.Validate()
+}
+
+// Accepts either a string set or a list of strings
+func stringList(name string, attribute *dynamodb.AttributeValue) ([]string, error) {
+	if attribute.SS != nil {
+		return aws.StringValueSlice(attribute.SS), nil
+	}
+
+	if attribute.L != nil {
+		values := make([]string, len(attribute.L))
+
+		for i := range attribute.L {
+			if attribute.L[i].S == nil {
+				return nil, fmt.Errorf("Attribute %s must only contain strings", name)
+			}
+
+			values[i] = *attribute.L[i].S
+		}
+
+		return values, nil
+	}
+
+	return nil, fmt.Errorf("Attribute %s must be a string set or a list of strings", name)
+}
+
+// Accepts a duration string such as "30s" or a number of seconds
+func duration(name string, attribute *dynamodb.AttributeValue) (time.Duration, error) {
+	if attribute.S != nil {
+		return time.ParseDuration(*attribute.S)
+	}
+
+	if attribute.N != nil {
+		seconds, err := strconv.ParseFloat(*attribute.N, 64)
+
+		if err != nil {
+			return 0, err
+		}
+
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+
+	return 0, fmt.Errorf("Attribute %s must be a duration string or a number of seconds", name)
+}
+
+// Accepts a boolean to toggle TLS with the defaults, or a map of server_name, insecure_skip_verify and ca_file
+func tlsConfig(attribute *dynamodb.AttributeValue) (*backends.TLSConfig, error) {
+	if attribute.BOOL != nil {
+		if *attribute.BOOL {
+			return &backends.TLSConfig{}, nil
+		}
+
+		return nil, nil
+	}
+
+	if attribute.M == nil {
+		return nil, fmt.Errorf("Attribute tls must be a boolean or a map")
+	}
+
+	config := &backends.TLSConfig{}
+
+	if value, ok := attribute.M["server_name"]; ok && value.S != nil {
+		config.ServerName = *value.S
+	}
+
+	if value, ok := attribute.M["insecure_skip_verify"]; ok && value.BOOL != nil {
+		config.InsecureSkipVerify = *value.BOOL
+	}
+
+	if value, ok := attribute.M["ca_file"]; ok && value.S != nil {
+		config.CAFile = *value.S
+	}
+
+	return config, nil
+}
+
 func CreateDynamoDbBackend(proxy_name string, tablename string, awsConfig *aws.Config) *DynamoDbBackend {
 	return &DynamoDbBackend{
 		proxy_name: proxy_name,
@@ -63,7 +281,7 @@ func CreateDynamoDbBackend(proxy_name string, tablename string, awsConfig *aws.C
 type DynamoDbBackend struct {
 	tablename string
 	proxy_name string
-	database  *dynamodb.DynamoDB
+	database  dynamodbiface.DynamoDBAPI
 }
 
 func (d *DynamoDbBackend) CreateProxyConfiguration(proxy_configuration string) error {
@@ -78,21 +296,46 @@ func (d *DynamoDbBackend) DeleteProxyConfiguration(proxy_configuration string) e
 	return err
 }
 
-func (d *DynamoDbBackend) GetProxyConfigurations() ([]backends.ConnectionConfig, error) {
+func (d *DynamoDbBackend) SetProxyConfigurationEnabled(proxy_configuration string, enabled bool) error {
+	_, err := d.database.UpdateItem(setProxyEnabled(d.tablename, d.proxy_name, proxy_configuration, enabled))
+
+	return err
+}
+
+// ListProxyConfigurations returns every configuration of the proxy, including the disabled ones.
+func (d *DynamoDbBackend) ListProxyConfigurations() ([]backends.ConnectionConfig, error) {
+	return d.listProxyConfigurations(context.Background())
+}
+
+func (d *DynamoDbBackend) listProxyConfigurations(ctx context.Context) ([]backends.ConnectionConfig, error) {
+	ctx, span := tracer().Start(ctx, "DynamoDB.Query", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("rpc.system", "aws-api"),
+		attribute.String("rpc.service", "DynamoDB"),
+		attribute.String("rpc.method", "Query"),
+		attribute.StringSlice("aws.dynamodb.table_names", []string{d.tablename}),
+	))
+	defer span.End()
+
 	// TODO For now this is limited to 1MB of items before it hits pagination, which it doesnt implement yet.
-	result, err := d.database.Query(getProxiesWithName(d.tablename, d.proxy_name))
+	result, err := d.database.QueryWithContext(ctx, getProxiesWithName(d.tablename, d.proxy_name))
 
 	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 		return nil, err
 	}
 
+	span.SetAttributes(attribute.Int("aws.dynamodb.count", len(result.Items)))
+
 	var connections = make([]backends.ConnectionConfig, len(result.Items))
 
+	// A malformed item is listed with its error, so it can still be seen and removed
 	for i := range result.Items {
-		connection, err := backends.ParseConnection(*result.Items[i]["proxy_configuration"].S)
+		connection, err := parseItem(result.Items[i])
 
 		if err != nil {
-			return nil, err
+			connections[i] = backends.ConnectionConfig{Url: rawConfiguration(result.Items[i]), Invalid: err.Error()}
+			continue
 		}
 
 		connections[i] = *connection
@@ -101,6 +344,40 @@ func (d *DynamoDbBackend) GetProxyConfigurations() ([]backends.ConnectionConfig,
 	return connections, nil
 }
 
+func rawConfiguration(item map[string]*dynamodb.AttributeValue) string {
+	if configuration, ok := item["proxy_configuration"]; ok && configuration.S != nil {
+		return *configuration.S
+	}
+
+	return ""
+}
+
+func (d *DynamoDbBackend) GetProxyConfigurations() ([]backends.ConnectionConfig, error) {
+	return d.GetProxyConfigurationsWithContext(context.Background())
+}
+
+func (d *DynamoDbBackend) GetProxyConfigurationsWithContext(ctx context.Context) ([]backends.ConnectionConfig, error) {
+	all, err := d.listProxyConfigurations(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var connections = make([]backends.ConnectionConfig, 0, len(all))
+
+	for i := range all {
+		if all[i].Invalid != "" {
+			return nil, fmt.Errorf("Invalid configuration '%s': %s", all[i].Url, all[i].Invalid)
+		}
+
+		if !all[i].Disabled {
+			connections = append(connections, all[i])
+		}
+	}
+
+	return connections, nil
+}
+
 func (b *DynamoDbBackend) IsPollable() bool {
 	return true
 }
@@ -0,0 +1,133 @@
+package dynamodb
+
+import (
+	"context"
+	"testing"
+	"time"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/brandnetworks/tcpproxy/backends"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestParseLegacyItem(t *testing.T) {
+	connection, err := parseItem(map[string]*dynamodb.AttributeValue{
+		"proxy_name":          {S: aws.String("test")},
+		"proxy_configuration": {S: aws.String("8002:example.com:5432")},
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, ":8002", connection.LocalAddress)
+	assert.Equal(t, "example.com:5432", connection.RemoteAddress)
+	assert.Equal(t, []backends.Target{{Address: "example.com:5432", Weight: 1}}, connection.Upstreams())
+	assert.False(t, connection.Disabled)
+	assert.Nil(t, connection.TLS)
+}
+
+func TestParseTypedItem(t *testing.T) {
+	connection, err := parseItem(map[string]*dynamodb.AttributeValue{
+		"proxy_name":          {S: aws.String("test")},
+		"proxy_configuration": {S: aws.String("8002:example.com:5432")},
+		"targets":             {L: []*dynamodb.AttributeValue{{S: aws.String("db1:5432")}, {S: aws.String("db2:5432")}}},
+		"dial_timeout":        {S: aws.String("5s")},
+		"idle_timeout":        {N: aws.String("300")},
+		"tls":                 {M: map[string]*dynamodb.AttributeValue{"server_name": {S: aws.String("db.internal")}}},
+		"allowed_cidrs":       {SS: []*string{aws.String("10.0.0.0/8")}},
+		"enabled":             {BOOL: aws.Bool(false)},
+		"description":         {S: aws.String("Reporting database")},
+		"owner":               {S: aws.String("data-team")},
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []backends.Target{{Address: "db1:5432", Weight: 1}, {Address: "db2:5432", Weight: 1}}, connection.Upstreams())
+	assert.Equal(t, 5*time.Second, connection.DialTimeout)
+	assert.Equal(t, 5*time.Minute, connection.IdleTimeout)
+	assert.Equal(t, &backends.TLSConfig{ServerName: "db.internal"}, connection.TLS)
+	assert.Equal(t, []string{"10.0.0.0/8"}, connection.AllowedCIDRs)
+	assert.True(t, connection.Disabled)
+	assert.Equal(t, "Reporting database", connection.Description)
+	assert.Equal(t, "data-team", connection.Owner)
+}
+
+func TestParseInvalidItem(t *testing.T) {
+	_, err := parseItem(map[string]*dynamodb.AttributeValue{
+		"proxy_configuration": {S: aws.String("8002:example.com:5432")},
+		"allowed_cidrs":       {SS: []*string{aws.String("not-a-cidr")}},
+	})
+
+	assert.NotNil(t, err)
+
+	_, err = parseItem(map[string]*dynamodb.AttributeValue{
+		"proxy_configuration": {S: aws.String("8002:example.com:5432")},
+		"enabled":             {S: aws.String("yes")},
+	})
+
+	assert.NotNil(t, err)
+}
+
+type mockDynamoDb struct {
+	dynamodbiface.DynamoDBAPI
+	items []map[string]*dynamodb.AttributeValue
+}
+
+func (m *mockDynamoDb) QueryWithContext(aws.Context, *dynamodb.QueryInput, ...request.Option) (*dynamodb.QueryOutput, error) {
+	return &dynamodb.QueryOutput{Items: m.items}, nil
+}
+
+func TestQuerySpan(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "poll")
+
+	backend := &DynamoDbBackend{
+		tablename:  "classic-proxy",
+		proxy_name: "test",
+		database: &mockDynamoDb{items: []map[string]*dynamodb.AttributeValue{
+			{"proxy_configuration": {S: aws.String("8001:example.com:5431")}},
+			{"proxy_configuration": {S: aws.String("8002:example.com:5432")}, "enabled": {BOOL: aws.Bool(false)}},
+		}},
+	}
+
+	connections, err := backend.GetProxyConfigurationsWithContext(ctx)
+	parent.End()
+
+	assert.Nil(t, err)
+	assert.Len(t, connections, 1)
+
+	spans := exporter.GetSpans()
+	assert.Len(t, spans, 2)
+	assert.Equal(t, "DynamoDB.Query", spans[0].Name)
+	assert.Equal(t, parent.SpanContext().SpanID(), spans[0].Parent.SpanID())
+	assert.Contains(t, spans[0].Attributes, attribute.StringSlice("aws.dynamodb.table_names", []string{"classic-proxy"}))
+	assert.Contains(t, spans[0].Attributes, attribute.Int("aws.dynamodb.count", 2))
+}
+
+func TestListInvalidItem(t *testing.T) {
+	backend := &DynamoDbBackend{
+		tablename:  "classic-proxy",
+		proxy_name: "test",
+		database: &mockDynamoDb{items: []map[string]*dynamodb.AttributeValue{
+			{"proxy_configuration": {S: aws.String("8001:example.com:5431")}},
+			{"proxy_configuration": {S: aws.String("8002:example.com")}},
+		}},
+	}
+
+	connections, err := backend.ListProxyConfigurations()
+
+	assert.Nil(t, err)
+	assert.Len(t, connections, 2)
+	assert.Equal(t, "", connections[0].Invalid)
+	assert.Equal(t, "8002:example.com", connections[1].Url)
+	assert.NotEqual(t, "", connections[1].Invalid)
+
+	// Polls still fail rather than drop the route
+	_, err = backend.GetProxyConfigurations()
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,147 @@
+package ec2
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/brandnetworks/tcpproxy/backends"
+	"sort"
+	"strconv"
+	"strings"
+	"fmt"
+	"log/slog"
+)
+
+// ParseTags parses a comma separated list of key=value tag filters.
+func ParseTags(tagsArg string) (map[string]string, error) {
+	if len(tagsArg) == 0 {
+		return nil, fmt.Errorf("Tags must not be empty")
+	}
+
+	tags := make(map[string]string)
+
+	for _, pair := range strings.Split(tagsArg, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("A tag must have two parts: key=value '%s'", pair)
+		}
+
+		tags[parts[0]] = parts[1]
+	}
+
+	return tags, nil
+}
+
+// CreateEc2Backend balances localPort across the private IPs of the running instances carrying all of the tags.
+func CreateEc2Backend(logger *slog.Logger, tags map[string]string, localPort int, remotePort int, awsConfig *aws.Config) *Ec2Backend {
+	return &Ec2Backend{
+		logger: logger,
+		tags: tags,
+		localPort: strconv.Itoa(localPort),
+		remotePort: strconv.Itoa(remotePort),
+		ec2: ec2.New(session.New(), awsConfig),
+	}
+}
+
+type Ec2Backend struct {
+	logger *slog.Logger
+	tags map[string]string
+	localPort string
+	remotePort string
+	ec2 ec2iface.EC2API
+}
+
+func (d *Ec2Backend) filters() ([]*ec2.Filter, string) {
+	keys := make([]string, 0, len(d.tags))
+
+	for key := range d.tags {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	filters := []*ec2.Filter{{
+		Name: aws.String("instance-state-name"),
+		Values: []*string{aws.String("running")},
+	}}
+
+	names := make([]string, len(keys))
+
+	for i, key := range keys {
+		filters = append(filters, &ec2.Filter{
+			Name: aws.String("tag:" + key),
+			Values: []*string{aws.String(d.tags[key])},
+		})
+
+		names[i] = key + "=" + d.tags[key]
+	}
+
+	return filters, strings.Join(names, ",")
+}
+
+func (d *Ec2Backend) GetProxyConfigurations() ([]backends.ConnectionConfig, error) {
+	filters, name := d.filters()
+
+	d.logger.Debug("Describing instances", "tags", name)
+
+	addresses := make([]string, 0)
+
+	err := d.ec2.DescribeInstancesPages(&ec2.DescribeInstancesInput{
+		Filters: filters,
+	}, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		for _, reservation := range page.Reservations {
+			for _, instance := range reservation.Instances {
+				if instance.PrivateIpAddress != nil {
+					addresses = append(addresses, *instance.PrivateIpAddress)
+				}
+			}
+		}
+
+		return true
+	})
+
+	if err != nil {
+		d.logger.Error("Error describing instances", "tags", name, "error", err)
+		return nil, err
+	}
+
+	d.logger.Debug("Found instances", "tags", name, "instances", len(addresses))
+
+	if len(addresses) == 0 {
+		return []backends.ConnectionConfig{}, nil
+	}
+
+	// Sorted so an unchanged group doesn't look like a changed configuration
+	sort.Strings(addresses)
+
+	targets := make([]backends.Target, len(addresses))
+
+	for i, address := range addresses {
+		targets[i] = backends.Target{Address: address + ":" + d.remotePort, Weight: 1}
+	}
+
+	// The url names the tags rather than the instances, so the group scaling updates the connection in place
+	return []backends.ConnectionConfig{{
+		Name: name,
+		LocalAddress: ":" + d.localPort,
+		RemoteAddress: targets[0].Address,
+		Targets: targets,
+		Url: d.localPort + ":" + tagsKey(name) + ":" + d.remotePort,
+	}}, nil
+}
+
+// tagsKey identifies the tag filters in the url, where the commas separating them, and the colons of tags like
+// aws:autoscaling:groupName, would be read as separating urls and their parts.
+func tagsKey(name string) string {
+	sum := sha256.Sum256([]byte(name))
+
+	return "tags-" + hex.EncodeToString(sum[:6])
+}
+
+func (b *Ec2Backend) IsPollable() bool {
+	return true
+}
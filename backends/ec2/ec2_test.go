@@ -0,0 +1,71 @@
+package ec2
+
+import (
+	"log/slog"
+	"testing"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/brandnetworks/tcpproxy/backends"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockEc2 struct {
+	ec2iface.EC2API
+	filters   []*ec2.Filter
+	addresses []string
+}
+
+func (m *mockEc2) DescribeInstancesPages(input *ec2.DescribeInstancesInput, page func(*ec2.DescribeInstancesOutput, bool) bool) error {
+	m.filters = input.Filters
+
+	instances := make([]*ec2.Instance, len(m.addresses))
+
+	for i := range m.addresses {
+		instances[i] = &ec2.Instance{PrivateIpAddress: aws.String(m.addresses[i])}
+	}
+
+	page(&ec2.DescribeInstancesOutput{Reservations: []*ec2.Reservation{{Instances: instances}}}, true)
+	return nil
+}
+
+func TestParseTags(t *testing.T) {
+	tags, err := ParseTags("Name=web,aws:autoscaling:groupName=web-asg")
+
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"Name": "web", "aws:autoscaling:groupName": "web-asg"}, tags)
+
+	_, err = ParseTags("Name")
+	assert.NotNil(t, err)
+}
+
+func TestTaggedInstances(t *testing.T) {
+	mock := &mockEc2{addresses: []string{"10.0.0.12", "10.0.0.11"}}
+	backend := &Ec2Backend{logger: slog.New(slog.DiscardHandler), tags: map[string]string{"Name": "web", "Env": "prod"}, localPort: "8080", remotePort: "80", ec2: mock}
+
+	connections, err := backend.GetProxyConfigurations()
+
+	assert.Nil(t, err)
+	assert.Len(t, connections, 1)
+	assert.Equal(t, ":8080", connections[0].LocalAddress)
+	assert.Equal(t, "Env=prod,Name=web", connections[0].Name)
+	assert.Equal(t, "8080:tags-efd0078856d3:80", connections[0].Url)
+
+	// The url reads back as the one connection, for the routes command and the routes endpoints
+	parsed, err := backends.ParseConnectionsParameter(connections[0].Url)
+	assert.Nil(t, err)
+	assert.Len(t, parsed, 1)
+	assert.Equal(t, []backends.Target{{Address: "10.0.0.11:80", Weight: 1}, {Address: "10.0.0.12:80", Weight: 1}}, connections[0].Upstreams())
+
+	assert.Equal(t, []*ec2.Filter{
+		{Name: aws.String("instance-state-name"), Values: []*string{aws.String("running")}},
+		{Name: aws.String("tag:Env"), Values: []*string{aws.String("prod")}},
+		{Name: aws.String("tag:Name"), Values: []*string{aws.String("web")}},
+	}, mock.filters)
+
+	mock.addresses = []string{}
+	connections, err = backend.GetProxyConfigurations()
+
+	assert.Nil(t, err)
+	assert.Empty(t, connections)
+}
@@ -1,48 +1,254 @@
 package elasticache
 
 import (
+	"context"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/elasticache"
+	"github.com/aws/aws-sdk-go/service/elasticache/elasticacheiface"
 	"github.com/brandnetworks/tcpproxy/backends"
 	"sort"
 	"strconv"
+	"strings"
 	"fmt"
-	"log"
+	"log/slog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// Looked up on every call, so the provider configured at startup applies
+func tracer() trace.Tracer {
+	return otel.Tracer("github.com/brandnetworks/tcpproxy/backends/elasticache")
+}
+
 
-func CreateElasticacheBackend(logLevel int, cacheClusterId string, localPort int, awsConfig *aws.Config) *ElasticacheBackend {
+func CreateElasticacheBackend(logger *slog.Logger, cacheClusterId string, localPort int, awsConfig *aws.Config) *ElasticacheBackend {
 	return &ElasticacheBackend {
-		logLevel: logLevel,
+		logger: logger,
 		localPort: strconv.Itoa(localPort),
 		cacheClusterId: cacheClusterId,
 		elasticache: elasticache.New(session.New(), awsConfig),
 	}
 }
 
+// CreateElasticacheReplicationGroupBackend follows the primary of a replication group on localPort, and
+// balances across its replicas on readerPort unless readerPort is zero or less.
+func CreateElasticacheReplicationGroupBackend(logger *slog.Logger, replicationGroupId string, localPort int, readerPort int, awsConfig *aws.Config) *ElasticacheBackend {
+	backend := &ElasticacheBackend {
+		logger: logger,
+		localPort: strconv.Itoa(localPort),
+		replicationGroupId: replicationGroupId,
+		elasticache: elasticache.New(session.New(), awsConfig),
+	}
+
+	if readerPort > 0 {
+		backend.readerPort = strconv.Itoa(readerPort)
+	}
+
+	return backend
+}
+
+// CreateElasticacheAllNodesBackend proxies every node of the cluster on its own local port. A node listed in
+// nodePorts uses that port, any other node uses basePort offset by its id, so node 0001 is on basePort and 0003
+// on basePort + 2. Ports only depend on the node ids, so adding or removing nodes doesn't move the others.
+func CreateElasticacheAllNodesBackend(logger *slog.Logger, cacheClusterId string, basePort int, nodePorts map[string]int, awsConfig *aws.Config) *ElasticacheBackend {
+	return &ElasticacheBackend {
+		logger: logger,
+		cacheClusterId: cacheClusterId,
+		allNodes: true,
+		basePort: basePort,
+		nodePorts: nodePorts,
+		elasticache: elasticache.New(session.New(), awsConfig),
+	}
+}
+
+// ParseNodePorts parses a comma separated list of nodeId:localPort pairs.
+func ParseNodePorts(nodePortsArg string) (map[string]int, error) {
+	nodePorts := make(map[string]int)
+
+	if nodePortsArg == "" {
+		return nodePorts, nil
+	}
+
+	for _, pair := range strings.Split(nodePortsArg, ",") {
+		parts := strings.Split(pair, ":")
+
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("A node port must have two parts: nodeId:localPort '%s'", pair)
+		}
+
+		port, err := strconv.Atoi(parts[1])
+
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("Invalid local port '%s' for node %s", parts[1], parts[0])
+		}
+
+		nodePorts[parts[0]] = port
+	}
+
+	return nodePorts, nil
+}
+
+func (d *ElasticacheBackend) nodePort(nodeId string, id int) (int, bool) {
+	if port, ok := d.nodePorts[nodeId]; ok {
+		return port, true
+	}
+
+	if d.basePort > 0 && id > 0 {
+		return d.basePort + id - 1, true
+	}
+
+	return 0, false
+}
+
 type ElasticacheBackend struct {
-	logLevel int
+	logger *slog.Logger
 	localPort string
+	allNodes bool
+	basePort int
+	nodePorts map[string]int
+	readerPort string
 	cacheClusterId string
-	elasticache *elasticache.ElastiCache
+	replicationGroupId string
+	elasticache elasticacheiface.ElastiCacheAPI
 }
 
 func (d *ElasticacheBackend) GetProxyConfigurations() ([]backends.ConnectionConfig, error) {
+	return d.GetProxyConfigurationsWithContext(context.Background())
+}
+
+func (d *ElasticacheBackend) GetProxyConfigurationsWithContext(ctx context.Context) ([]backends.ConnectionConfig, error) {
+	if d.replicationGroupId != "" {
+		return d.getReplicationGroupConfigurations(ctx)
+	}
+
+	return d.getCacheClusterConfigurations(ctx)
+}
+
+// startCall starts the span of an ElastiCache API call, to be ended with endCall.
+func startCall(ctx context.Context, method string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	attributes = append([]attribute.KeyValue{
+		attribute.String("rpc.system", "aws-api"),
+		attribute.String("rpc.service", "ElastiCache"),
+		attribute.String("rpc.method", method),
+	}, attributes...)
+
+	return tracer().Start(ctx, "ElastiCache." + method, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attributes...))
+}
 
-	if d.logLevel > 0 {
-		log.Println("Describing cluster", d.cacheClusterId)
+func endCall(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 	}
 
+	span.End()
+}
+
+func (d *ElasticacheBackend) getReplicationGroupConfigurations(ctx context.Context) ([]backends.ConnectionConfig, error) {
+
+	d.logger.Debug("Describing replication group", "replication_group", d.replicationGroupId)
+
+	ctx, span := startCall(ctx, "DescribeReplicationGroups", attribute.String("aws.elasticache.replication_group_id", d.replicationGroupId))
+	groups, err := d.elasticache.DescribeReplicationGroupsWithContext(ctx, &elasticache.DescribeReplicationGroupsInput{
+		ReplicationGroupId: aws.String(d.replicationGroupId),
+	})
+	endCall(span, err)
+
+	if err != nil {
+		d.logger.Error("Error describing replication group", "replication_group", d.replicationGroupId, "error", err)
+		return nil, err
+	}
+
+	if len(groups.ReplicationGroups) != 1 || len(groups.ReplicationGroups[0].NodeGroups) == 0 {
+		return nil, fmt.Errorf("Replication group %s not found", d.replicationGroupId)
+	}
+
+	// Cluster mode spreads the keys across several node groups, which a single primary can't serve
+	if len(groups.ReplicationGroups[0].NodeGroups) > 1 {
+		return nil, fmt.Errorf("Replication group %s has cluster mode enabled, which is not supported", d.replicationGroupId)
+	}
+
+	nodeGroup := groups.ReplicationGroups[0].NodeGroups[0]
+
+	var primary *elasticache.Endpoint
+	replicas := make([]backends.Target, 0)
+
+	// The members know which node is the primary right now, the group's primary endpoint only follows through DNS
+	for _, member := range nodeGroup.NodeGroupMembers {
+		if member.ReadEndpoint == nil {
+			continue
+		}
+
+		switch aws.StringValue(member.CurrentRole) {
+		case "primary":
+			primary = member.ReadEndpoint
+		case "replica":
+			replicas = append(replicas, backends.Target{Address: endpointAddress(member.ReadEndpoint), Weight: 1})
+		}
+	}
+
+	if primary == nil {
+		primary = nodeGroup.PrimaryEndpoint
+	}
+
+	if primary == nil {
+		return nil, fmt.Errorf("Replication group %s has no primary", d.replicationGroupId)
+	}
+
+	d.logger.Debug("Found primary", "replication_group", d.replicationGroupId, "upstream", endpointAddress(primary), "replicas", len(replicas))
+
+	// The urls don't name the nodes, so a failover updates the connections in place rather than replacing them,
+	// the sessions of the primary are ended with it as the old one turns into a replica
+	connections := []backends.ConnectionConfig{{
+		Name: d.replicationGroupId + "::primary",
+		LocalAddress: ":" + d.localPort,
+		RemoteAddress: endpointAddress(primary),
+		Url: d.localPort + ":" + d.replicationGroupId + ":primary",
+		EndSessionsOnRetarget: true,
+	}}
+
+	if d.readerPort != "" {
+		reader := backends.ConnectionConfig{
+			Name: d.replicationGroupId + "::reader",
+			LocalAddress: ":" + d.readerPort,
+			RemoteAddress: endpointAddress(primary),
+			Targets: replicas,
+			Url: d.readerPort + ":" + d.replicationGroupId + ":reader",
+		}
+
+		// Only used without replicas, when the group's reader endpoint points at the primary
+		if nodeGroup.ReaderEndpoint != nil {
+			reader.RemoteAddress = endpointAddress(nodeGroup.ReaderEndpoint)
+		}
+
+		connections = append(connections, reader)
+	}
+
+	return connections, nil
+}
+
+func endpointAddress(endpoint *elasticache.Endpoint) string {
+	return fmt.Sprintf("%s:%v", aws.StringValue(endpoint.Address), aws.Int64Value(endpoint.Port))
+}
+
+func (d *ElasticacheBackend) getCacheClusterConfigurations(ctx context.Context) ([]backends.ConnectionConfig, error) {
+
+	d.logger.Debug("Describing cluster", "cluster", d.cacheClusterId)
+
 	// Paging shouldn't be a concern, as only 0 or 1 clusters should be returned by this call.
-	clusters, err := d.elasticache.DescribeCacheClusters(&elasticache.DescribeCacheClustersInput{
+	ctx, span := startCall(ctx, "DescribeCacheClusters", attribute.String("aws.elasticache.cache_cluster_id", d.cacheClusterId))
+	clusters, err := d.elasticache.DescribeCacheClustersWithContext(ctx, &elasticache.DescribeCacheClustersInput{
 		CacheClusterId:    aws.String(d.cacheClusterId),
 		MaxRecords:        aws.Int64(100),
 		ShowCacheNodeInfo: aws.Bool(true),
 	})
+	endCall(span, err)
 
 	if err != nil {
-		log.Println("Error describing cluster", d.cacheClusterId, err)
+		d.logger.Error("Error describing cluster", "cluster", d.cacheClusterId, "error", err)
 		return nil, err
 	}
 
@@ -52,31 +258,64 @@ func (d *ElasticacheBackend) GetProxyConfigurations() ([]backends.ConnectionConf
 	// Get all of the nodes for this cluster
 	for _, cluster := range clusters.CacheClusters {
 		for _, node := range cluster.CacheNodes {
-			backend, err := backends.ParseConnection(fmt.Sprintf("%v:%s:%v", d.localPort, *node.Endpoint.Address, *node.Endpoint.Port))
+			// Nodes still being created have no endpoint yet
+			if node.Endpoint == nil {
+				continue
+			}
+
+			id, err := strconv.Atoi(*node.CacheNodeId)
 
 			if err != nil {
 				return nil, err
 			}
 
-			backend.Name = *cluster.CacheClusterId + "::" + *node.CacheNodeId
+			localPort := d.localPort
 
-			id, err := strconv.Atoi(*node.CacheNodeId)
+			if d.allNodes {
+				port, ok := d.nodePort(*node.CacheNodeId, id)
+
+				if !ok {
+					d.logger.Warn("No local port for node, skipping it", "cluster", *cluster.CacheClusterId, "node", *node.CacheNodeId)
+					continue
+				}
+
+				localPort = strconv.Itoa(port)
+			}
+
+			backend, err := backends.ParseConnection(fmt.Sprintf("%v:%s:%v", localPort, *node.Endpoint.Address, *node.Endpoint.Port))
 
 			if err != nil {
 				return nil, err
 			}
 
+			backend.Name = *cluster.CacheClusterId + "::" + *node.CacheNodeId
+
 			pollResults[id] = *backend
 			nodeIDs = append(nodeIDs, id)
 		}
 	}
 
-	if d.logLevel > 0 {
-		log.Println("Found", len(nodeIDs), "nodeIDs")
-	}
+	d.logger.Debug("Found nodes", "cluster", d.cacheClusterId, "nodes", len(nodeIDs))
 
 	sort.Sort(sort.IntSlice(nodeIDs))
 
+	if d.allNodes {
+		connections := make([]backends.ConnectionConfig, len(nodeIDs))
+		ports := make(map[string]string, len(nodeIDs))
+
+		for i, id := range nodeIDs {
+			connections[i] = pollResults[id]
+
+			if other, ok := ports[connections[i].LocalAddress]; ok {
+				return nil, fmt.Errorf("Nodes %s and %s are both mapped to local port %s", other, connections[i].Name, connections[i].LocalAddress)
+			}
+
+			ports[connections[i].LocalAddress] = connections[i].Name
+		}
+
+		return connections, nil
+	}
+
 	// Select the lowest id no
 	if len(nodeIDs) == 0 {
 		return []backends.ConnectionConfig{}, nil
@@ -0,0 +1,231 @@
+package elasticache
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/elasticache"
+	"github.com/aws/aws-sdk-go/service/elasticache/elasticacheiface"
+	"github.com/brandnetworks/tcpproxy/backends"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+type mockElastiCache struct {
+	elasticacheiface.ElastiCacheAPI
+	clusters *elasticache.DescribeCacheClustersOutput
+	groups   *elasticache.DescribeReplicationGroupsOutput
+}
+
+func (m *mockElastiCache) DescribeCacheClustersWithContext(aws.Context, *elasticache.DescribeCacheClustersInput, ...request.Option) (*elasticache.DescribeCacheClustersOutput, error) {
+	return m.clusters, nil
+}
+
+func (m *mockElastiCache) DescribeReplicationGroupsWithContext(aws.Context, *elasticache.DescribeReplicationGroupsInput, ...request.Option) (*elasticache.DescribeReplicationGroupsOutput, error) {
+	return m.groups, nil
+}
+
+func endpoint(address string, port int64) *elasticache.Endpoint {
+	return &elasticache.Endpoint{Address: aws.String(address), Port: aws.Int64(port)}
+}
+
+func member(id string, role string, address string) *elasticache.NodeGroupMember {
+	return &elasticache.NodeGroupMember{
+		CacheClusterId: aws.String(id),
+		CurrentRole:    aws.String(role),
+		ReadEndpoint:   endpoint(address, 6379),
+	}
+}
+
+func replicationGroup(members ...*elasticache.NodeGroupMember) *elasticache.DescribeReplicationGroupsOutput {
+	return &elasticache.DescribeReplicationGroupsOutput{
+		ReplicationGroups: []*elasticache.ReplicationGroup{{
+			ReplicationGroupId: aws.String("sessions"),
+			NodeGroups: []*elasticache.NodeGroup{{
+				PrimaryEndpoint:  endpoint("sessions.primary", 6379),
+				ReaderEndpoint:   endpoint("sessions.reader", 6379),
+				NodeGroupMembers: members,
+			}},
+		}},
+	}
+}
+
+func TestCacheClusterSelectsLowestNode(t *testing.T) {
+	backend := &ElasticacheBackend{
+		logger:         slog.New(slog.DiscardHandler),
+		localPort:      "6379",
+		cacheClusterId: "memcached",
+		elasticache: &mockElastiCache{clusters: &elasticache.DescribeCacheClustersOutput{
+			CacheClusters: []*elasticache.CacheCluster{{
+				CacheClusterId: aws.String("memcached"),
+				CacheNodes: []*elasticache.CacheNode{
+					{CacheNodeId: aws.String("0002"), Endpoint: endpoint("node2", 11211)},
+					{CacheNodeId: aws.String("0001"), Endpoint: endpoint("node1", 11211)},
+				},
+			}},
+		}},
+	}
+
+	connections, err := backend.GetProxyConfigurations()
+
+	assert.Nil(t, err)
+	assert.Len(t, connections, 1)
+	assert.Equal(t, "node1:11211", connections[0].RemoteAddress)
+}
+
+func clusterNodes(ids ...string) *elasticache.DescribeCacheClustersOutput {
+	nodes := make([]*elasticache.CacheNode, len(ids))
+
+	for i, id := range ids {
+		nodes[i] = &elasticache.CacheNode{CacheNodeId: aws.String(id), Endpoint: endpoint("node" + id, 11211)}
+	}
+
+	return &elasticache.DescribeCacheClustersOutput{
+		CacheClusters: []*elasticache.CacheCluster{{CacheClusterId: aws.String("memcached"), CacheNodes: nodes}},
+	}
+}
+
+func localAddresses(connections []backends.ConnectionConfig) map[string]string {
+	addresses := make(map[string]string)
+
+	for _, connection := range connections {
+		addresses[connection.Name] = connection.LocalAddress
+	}
+
+	return addresses
+}
+
+func TestAllNodesKeepTheirPorts(t *testing.T) {
+	mock := &mockElastiCache{clusters: clusterNodes("0001", "0002", "0003")}
+	backend := &ElasticacheBackend{logger: slog.New(slog.DiscardHandler), cacheClusterId: "memcached", allNodes: true, basePort: 11211, elasticache: mock}
+
+	connections, err := backend.GetProxyConfigurations()
+
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"memcached::0001": ":11211",
+		"memcached::0002": ":11212",
+		"memcached::0003": ":11213",
+	}, localAddresses(connections))
+
+	// Removing a node and adding another leaves the remaining nodes where they were
+	mock.clusters = clusterNodes("0001", "0003", "0004")
+	connections, err = backend.GetProxyConfigurations()
+
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"memcached::0001": ":11211",
+		"memcached::0003": ":11213",
+		"memcached::0004": ":11214",
+	}, localAddresses(connections))
+}
+
+func TestAllNodesExplicitPorts(t *testing.T) {
+	nodePorts, err := ParseNodePorts("0001:7001,0002:7005")
+	assert.Nil(t, err)
+
+	backend := &ElasticacheBackend{
+		logger:         slog.New(slog.DiscardHandler),
+		cacheClusterId: "memcached",
+		allNodes:       true,
+		nodePorts:      nodePorts,
+		elasticache:    &mockElastiCache{clusters: clusterNodes("0001", "0002", "0003")},
+	}
+
+	connections, err := backend.GetProxyConfigurations()
+
+	// Without a base port the unmapped node is skipped
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"memcached::0001": ":7001",
+		"memcached::0002": ":7005",
+	}, localAddresses(connections))
+
+	// Node 0003 would be on 7005 too, which is already mapped to node 0002
+	backend.basePort = 7003
+	_, err = backend.GetProxyConfigurations()
+	assert.NotNil(t, err)
+}
+
+func TestReplicationGroupFollowsPrimary(t *testing.T) {
+	mock := &mockElastiCache{groups: replicationGroup(
+		member("sessions-001", "primary", "node1"),
+		member("sessions-002", "replica", "node2"),
+		member("sessions-003", "replica", "node3"),
+	)}
+
+	backend := &ElasticacheBackend{logger: slog.New(slog.DiscardHandler), localPort: "6379", readerPort: "6380", replicationGroupId: "sessions", elasticache: mock}
+
+	connections, err := backend.GetProxyConfigurations()
+
+	assert.Nil(t, err)
+	assert.Len(t, connections, 2)
+	assert.Equal(t, ":6379", connections[0].LocalAddress)
+	assert.Equal(t, "node1:6379", connections[0].RemoteAddress)
+	assert.Equal(t, ":6380", connections[1].LocalAddress)
+	assert.Equal(t, []backends.Target{{Address: "node2:6379", Weight: 1}, {Address: "node3:6379", Weight: 1}}, connections[1].Upstreams())
+
+	// Only the sessions of the primary have to move with it
+	assert.True(t, connections[0].EndSessionsOnRetarget)
+	assert.False(t, connections[1].EndSessionsOnRetarget)
+
+	// After a failover the connections keep their urls, so they are updated rather than replaced
+	mock.groups = replicationGroup(
+		member("sessions-001", "replica", "node1"),
+		member("sessions-002", "primary", "node2"),
+		member("sessions-003", "replica", "node3"),
+	)
+
+	failedOver, err := backend.GetProxyConfigurations()
+
+	assert.Nil(t, err)
+	assert.Equal(t, connections[0].Url, failedOver[0].Url)
+	assert.Equal(t, "node2:6379", failedOver[0].RemoteAddress)
+	assert.Equal(t, []backends.Target{{Address: "node1:6379", Weight: 1}, {Address: "node3:6379", Weight: 1}}, failedOver[1].Upstreams())
+}
+
+func TestReplicationGroupWithoutReplicas(t *testing.T) {
+	backend := &ElasticacheBackend{
+		logger:             slog.New(slog.DiscardHandler),
+		localPort:          "6379",
+		readerPort:         "6380",
+		replicationGroupId: "sessions",
+		elasticache:        &mockElastiCache{groups: replicationGroup(member("sessions-001", "primary", "node1"))},
+	}
+
+	connections, err := backend.GetProxyConfigurations()
+
+	assert.Nil(t, err)
+	assert.Equal(t, []backends.Target{{Address: "sessions.reader:6379", Weight: 1}}, connections[1].Upstreams())
+}
+
+func TestDescribeCallSpans(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "poll")
+
+	backend := &ElasticacheBackend{
+		logger:             slog.New(slog.DiscardHandler),
+		localPort:          "6379",
+		replicationGroupId: "redis",
+		elasticache:        &mockElastiCache{groups: replicationGroup(member("redis-001", "primary", "node1"))},
+	}
+
+	_, err := backend.GetProxyConfigurationsWithContext(ctx)
+	parent.End()
+
+	assert.Nil(t, err)
+
+	spans := exporter.GetSpans()
+	assert.Len(t, spans, 2)
+	assert.Equal(t, "ElastiCache.DescribeReplicationGroups", spans[0].Name)
+	assert.Equal(t, parent.SpanContext().SpanID(), spans[0].Parent.SpanID())
+	assert.Contains(t, spans[0].Attributes, attribute.String("rpc.method", "DescribeReplicationGroups"))
+	assert.Contains(t, spans[0].Attributes, attribute.String("aws.elasticache.replication_group_id", "redis"))
+}
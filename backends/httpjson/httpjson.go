@@ -0,0 +1,270 @@
+package httpjson
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/brandnetworks/tcpproxy/backends"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"fmt"
+	"log/slog"
+)
+
+const requestTimeout = 30 * time.Second
+
+// Far more than any real list of routes, it only stops a misbehaving server from exhausting memory
+const maxBodySize = 10 << 20
+
+// The document served at the url
+type document struct {
+	Routes []route `json:"routes"`
+}
+
+// A route mirrors the optional attributes of the dynamodb backend
+type route struct {
+	Connection   string          `json:"connection"`
+	Targets      []target        `json:"targets"`
+	DialTimeout  string          `json:"dial_timeout"`
+	IdleTimeout  string          `json:"idle_timeout"`
+	TLS          json.RawMessage `json:"tls"`
+	AllowedCIDRs []string        `json:"allowed_cidrs"`
+	Enabled      *bool           `json:"enabled"`
+	Description  string          `json:"description"`
+	Owner        string          `json:"owner"`
+}
+
+type target backends.Target
+
+// Targets are either "host:port" strings or objects with an address, priority and weight
+func (t *target) UnmarshalJSON(data []byte) error {
+	var address string
+
+	if err := json.Unmarshal(data, &address); err == nil {
+		*t = target{Address: address, Weight: 1}
+		return nil
+	}
+
+	var object struct {
+		Address  string `json:"address"`
+		Priority int    `json:"priority"`
+		Weight   *int   `json:"weight"`
+	}
+
+	if err := json.Unmarshal(data, &object); err != nil {
+		return fmt.Errorf("A target must be a host:port string or an object: %v", err)
+	}
+
+	*t = target{Address: object.Address, Priority: object.Priority, Weight: 1}
+
+	if object.Weight != nil {
+		t.Weight = *object.Weight
+	}
+
+	return nil
+}
+
+type tlsSettings struct {
+	ServerName         string `json:"server_name"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+	CAFile             string `json:"ca_file"`
+}
+
+func (r route) connectionConfig() (*backends.ConnectionConfig, error) {
+	connection, err := backends.ParseConnection(r.Connection)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, target := range r.Targets {
+		connection.Targets = append(connection.Targets, backends.Target(target))
+	}
+
+	if r.DialTimeout != "" {
+		if connection.DialTimeout, err = time.ParseDuration(r.DialTimeout); err != nil {
+			return nil, err
+		}
+	}
+
+	if r.IdleTimeout != "" {
+		if connection.IdleTimeout, err = time.ParseDuration(r.IdleTimeout); err != nil {
+			return nil, err
+		}
+	}
+
+	// tls is either a boolean toggling it with the defaults, or the settings
+	if len(r.TLS) > 0 && string(r.TLS) != "null" {
+		var enabled bool
+
+		if err := json.Unmarshal(r.TLS, &enabled); err == nil {
+			if enabled {
+				connection.TLS = &backends.TLSConfig{}
+			}
+		} else {
+			var settings tlsSettings
+
+			if err := json.Unmarshal(r.TLS, &settings); err != nil {
+				return nil, fmt.Errorf("Attribute tls of '%s' must be a boolean or an object", r.Connection)
+			}
+
+			connection.TLS = &backends.TLSConfig{
+				ServerName:         settings.ServerName,
+				InsecureSkipVerify: settings.InsecureSkipVerify,
+				CAFile:             settings.CAFile,
+			}
+		}
+	}
+
+	connection.AllowedCIDRs = r.AllowedCIDRs
+	connection.Disabled = r.Enabled != nil && !*r.Enabled
+	connection.Description = r.Description
+	connection.Owner = r.Owner
+
+	return connection, connection.Validate()
+}
+
+// CreateHttpJsonBackend fetches the routes from url. The auth header is only sent when authHeaderValue isn't
+// empty, and when signingKey isn't empty the body must carry a matching HMAC-SHA256 in the signature header.
+func CreateHttpJsonBackend(logger *slog.Logger, url string, authHeaderName string, authHeaderValue string, signatureHeader string, signingKey string) *HttpJsonBackend {
+	return &HttpJsonBackend{
+		logger: logger,
+		url: url,
+		authHeaderName: authHeaderName,
+		authHeaderValue: authHeaderValue,
+		signatureHeader: signatureHeader,
+		signingKey: []byte(signingKey),
+		client: &http.Client{Timeout: requestTimeout},
+	}
+}
+
+type HttpJsonBackend struct {
+	logger *slog.Logger
+	url string
+	authHeaderName string
+	authHeaderValue string
+	signatureHeader string
+	signingKey []byte
+	client *http.Client
+
+	// The last document fetched, returned again while the server answers 304 Not Modified
+	lock sync.Mutex
+	etag string
+	connections []backends.ConnectionConfig
+}
+
+func (d *HttpJsonBackend) GetProxyConfigurations() ([]backends.ConnectionConfig, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	request, err := http.NewRequest("GET", d.url, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Set("Accept", "application/json")
+
+	if d.authHeaderValue != "" {
+		request.Header.Set(d.authHeaderName, d.authHeaderValue)
+	}
+
+	if d.etag != "" {
+		request.Header.Set("If-None-Match", d.etag)
+	}
+
+	response, err := d.client.Do(request)
+
+	if err != nil {
+		d.logger.Error("Error fetching routes", "url", d.url, "error", err)
+		return nil, err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotModified {
+		d.logger.Debug("Routes not modified", "url", d.url)
+
+		// A copy, so callers changing the routes they're given don't change the ones kept here
+		return append([]backends.ConnectionConfig(nil), d.connections...), nil
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Fetching routes from %s responded %s", d.url, response.Status)
+	}
+
+	// One byte over the limit is read, to tell a body of exactly the limit from a longer one
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, maxBodySize + 1))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(body) > maxBodySize {
+		return nil, fmt.Errorf("Routes from %s are larger than %d bytes", d.url, maxBodySize)
+	}
+
+	if err := d.verify(body, response.Header.Get(d.signatureHeader)); err != nil {
+		return nil, err
+	}
+
+	var parsed document
+
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return nil, fmt.Errorf("Invalid routes from %s: %v", d.url, err)
+	}
+
+	connections := make([]backends.ConnectionConfig, 0, len(parsed.Routes))
+
+	for _, route := range parsed.Routes {
+		connection, err := route.connectionConfig()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !connection.Disabled {
+			connections = append(connections, *connection)
+		}
+	}
+
+	d.etag = response.Header.Get("ETag")
+	d.connections = connections
+
+	return append([]backends.ConnectionConfig(nil), connections...), nil
+}
+
+// verify checks a "sha256=<hex>" HMAC of the body, as sent by most webhooks.
+func (d *HttpJsonBackend) verify(body []byte, signature string) error {
+	if len(d.signingKey) == 0 {
+		return nil
+	}
+
+	if !strings.HasPrefix(signature, "sha256=") {
+		return fmt.Errorf("Routes from %s are not signed", d.url)
+	}
+
+	expected, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+
+	if err != nil {
+		return fmt.Errorf("Routes from %s have a malformed signature", d.url)
+	}
+
+	mac := hmac.New(sha256.New, d.signingKey)
+	mac.Write(body)
+
+	if !hmac.Equal(expected, mac.Sum(nil)) {
+		return fmt.Errorf("Routes from %s have an invalid signature", d.url)
+	}
+
+	return nil
+}
+
+func (b *HttpJsonBackend) IsPollable() bool {
+	return true
+}
@@ -0,0 +1,136 @@
+package httpjson
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"github.com/brandnetworks/tcpproxy/backends"
+	"github.com/stretchr/testify/assert"
+)
+
+const routes = `{"routes": [
+	{"connection": "8002:db.example.com:5432", "targets": ["db1:5432", {"address": "db2:5432", "priority": 1}],
+	 "dial_timeout": "5s", "tls": true, "owner": "data-team"},
+	{"connection": "8003:old.example.com:5432", "enabled": false}
+]}`
+
+func sign(key string, body string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestFetchRoutes(t *testing.T) {
+	requests := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(routes))
+	}))
+	defer server.Close()
+
+	backend := CreateHttpJsonBackend(slog.New(slog.DiscardHandler), server.URL, "Authorization", "Bearer secret", "X-Signature", "")
+
+	connections, err := backend.GetProxyConfigurations()
+
+	assert.Nil(t, err)
+	assert.Len(t, connections, 1)
+	assert.Equal(t, ":8002", connections[0].LocalAddress)
+	assert.Equal(t, []backends.Target{{Address: "db1:5432", Weight: 1}, {Address: "db2:5432", Priority: 1, Weight: 1}}, connections[0].Upstreams())
+	assert.Equal(t, 5*time.Second, connections[0].DialTimeout)
+	assert.Equal(t, &backends.TLSConfig{}, connections[0].TLS)
+	assert.Equal(t, "data-team", connections[0].Owner)
+
+	// The second fetch is answered with 304, which keeps the routes of the first
+	unchanged, err := backend.GetProxyConfigurations()
+
+	assert.Nil(t, err)
+	assert.Equal(t, 2, requests)
+	assert.Equal(t, connections, unchanged)
+
+	// Whatever the caller does with the routes, the kept ones stay as fetched
+	unchanged[0].Owner = "someone-else"
+	unchanged, err = backend.GetProxyConfigurations()
+
+	assert.Nil(t, err)
+	assert.Equal(t, "data-team", unchanged[0].Owner)
+
+	unauthorised := CreateHttpJsonBackend(slog.New(slog.DiscardHandler), server.URL, "Authorization", "", "X-Signature", "")
+	_, err = unauthorised.GetProxyConfigurations()
+	assert.NotNil(t, err)
+}
+
+func TestSignedRoutes(t *testing.T) {
+	signature := sign("signing-key", routes)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Signature", signature)
+		w.Write([]byte(routes))
+	}))
+	defer server.Close()
+
+	backend := CreateHttpJsonBackend(slog.New(slog.DiscardHandler), server.URL, "Authorization", "", "X-Signature", "signing-key")
+
+	connections, err := backend.GetProxyConfigurations()
+
+	assert.Nil(t, err)
+	assert.Len(t, connections, 1)
+
+	signature = sign("another-key", routes)
+	_, err = backend.GetProxyConfigurations()
+	assert.NotNil(t, err)
+
+	signature = ""
+	_, err = backend.GetProxyConfigurations()
+	assert.NotNil(t, err)
+}
+
+func TestInvalidRoutes(t *testing.T) {
+	body := `{"routes": [{"connection": "8002:db.example.com:5432", "allowed_cidrs": ["10.0.0.0/33"]}]}`
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	backend := CreateHttpJsonBackend(slog.New(slog.DiscardHandler), server.URL, "Authorization", "", "X-Signature", "")
+
+	_, err := backend.GetProxyConfigurations()
+	assert.NotNil(t, err)
+
+	body = `{"routes": [{"connection": "8002:db.example.com"}]}`
+	_, err = backend.GetProxyConfigurations()
+	assert.NotNil(t, err)
+}
+
+func TestOversizedRoutes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"routes": [], "padding": "`))
+		w.Write(bytes.Repeat([]byte("x"), maxBodySize))
+		w.Write([]byte(`"}`))
+	}))
+	defer server.Close()
+
+	backend := CreateHttpJsonBackend(slog.New(slog.DiscardHandler), server.URL, "Authorization", "", "X-Signature", "")
+
+	_, err := backend.GetProxyConfigurations()
+	assert.NotNil(t, err)
+}
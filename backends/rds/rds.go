@@ -0,0 +1,330 @@
+package rds
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
+	"github.com/brandnetworks/tcpproxy/backends"
+	"sort"
+	"strconv"
+	"strings"
+	"fmt"
+	"log/slog"
+	"sync"
+)
+
+// A database to proxy, either an Aurora cluster or a standalone instance with its read replicas.
+type Database struct {
+	Identifier string
+	Cluster    bool
+	WriterPort int
+	// Balances across every available reader, zero disables it
+	ReaderPort int
+}
+
+// ParseDatabases parses a comma separated list of cluster|instance:identifier:writerPort[:readerPort].
+func ParseDatabases(databasesArg string) ([]Database, error) {
+	if len(databasesArg) == 0 {
+		return nil, fmt.Errorf("Databases must not be empty")
+	}
+
+	databaseArgs := strings.Split(databasesArg, ",")
+	databases := make([]Database, len(databaseArgs))
+
+	for i, databaseArg := range databaseArgs {
+		parts := strings.Split(databaseArg, ":")
+
+		if len(parts) != 3 && len(parts) != 4 {
+			return nil, fmt.Errorf("A database must have the parts: cluster|instance:identifier:writerPort[:readerPort] '%s'", databaseArg)
+		}
+
+		switch parts[0] {
+		case "cluster":
+			databases[i].Cluster = true
+		case "instance":
+			databases[i].Cluster = false
+		default:
+			return nil, fmt.Errorf("A database must be a cluster or an instance '%s'", databaseArg)
+		}
+
+		databases[i].Identifier = parts[1]
+
+		ports := []*int{&databases[i].WriterPort, &databases[i].ReaderPort}
+
+		for j, port := range parts[2:] {
+			number, err := strconv.Atoi(port)
+
+			if err != nil || number < 1 || number > 65535 {
+				return nil, fmt.Errorf("Invalid port '%s' in database '%s'", port, databaseArg)
+			}
+
+			*ports[j] = number
+		}
+	}
+
+	return databases, nil
+}
+
+// ParseReaderPorts parses a comma separated list of instanceId:localPort pairs.
+func ParseReaderPorts(readerPortsArg string) (map[string]int, error) {
+	readerPorts := make(map[string]int)
+
+	if readerPortsArg == "" {
+		return readerPorts, nil
+	}
+
+	for _, pair := range strings.Split(readerPortsArg, ",") {
+		parts := strings.Split(pair, ":")
+
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("A reader port must have two parts: instanceId:localPort '%s'", pair)
+		}
+
+		port, err := strconv.Atoi(parts[1])
+
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("Invalid local port '%s' for reader %s", parts[1], parts[0])
+		}
+
+		readerPorts[parts[0]] = port
+	}
+
+	return readerPorts, nil
+}
+
+// CreateRdsBackend proxies the writer of each database on its writer port, and its readers on the reader port.
+// Readers listed in readerPorts are also proxied individually on their own local port.
+func CreateRdsBackend(logger *slog.Logger, databases []Database, readerPorts map[string]int, awsConfig *aws.Config) *RdsBackend {
+	return &RdsBackend{
+		logger: logger,
+		databases: databases,
+		readerPorts: readerPorts,
+		rds: rds.New(session.New(), awsConfig),
+	}
+}
+
+type RdsBackend struct {
+	logger *slog.Logger
+	databases []Database
+	readerPorts map[string]int
+	rds rdsiface.RDSAPI
+
+	// The last writer instance found of each cluster, kept while a failover leaves it without one
+	lock sync.Mutex
+	writers map[string]string
+}
+
+// The instances of a database, the writer first
+type topology struct {
+	writer  string
+	readers map[string]string
+}
+
+func (d *RdsBackend) GetProxyConfigurations() ([]backends.ConnectionConfig, error) {
+	connections := make([]backends.ConnectionConfig, 0)
+
+	for _, database := range d.databases {
+		var found *topology
+		var err error
+
+		if database.Cluster {
+			found, err = d.describeCluster(database.Identifier)
+		} else {
+			found, err = d.describeInstance(database.Identifier)
+		}
+
+		if err != nil {
+			d.logger.Error("Error describing database", "database", database.Identifier, "error", err)
+			return nil, err
+		}
+
+		d.logger.Debug("Found writer", "database", database.Identifier, "upstream", found.writer, "readers", len(found.readers))
+
+		connections = append(connections, d.connections(database, found)...)
+	}
+
+	return connections, nil
+}
+
+// The urls name the role rather than the endpoint, so a failover updates the connections in place. The
+// sessions of the writer end with it, the old writer only serves reads once it comes back.
+func (d *RdsBackend) connections(database Database, found *topology) []backends.ConnectionConfig {
+	writerPort := strconv.Itoa(database.WriterPort)
+
+	connections := []backends.ConnectionConfig{{
+		Name: database.Identifier + "::writer",
+		LocalAddress: ":" + writerPort,
+		RemoteAddress: found.writer,
+		Url: writerPort + ":" + database.Identifier + ":writer",
+		EndSessionsOnRetarget: true,
+	}}
+
+	instanceIds := make([]string, 0, len(found.readers))
+
+	for instanceId := range found.readers {
+		instanceIds = append(instanceIds, instanceId)
+	}
+
+	sort.Strings(instanceIds)
+
+	if database.ReaderPort > 0 {
+		readerPort := strconv.Itoa(database.ReaderPort)
+		targets := make([]backends.Target, len(instanceIds))
+
+		for i, instanceId := range instanceIds {
+			targets[i] = backends.Target{Address: found.readers[instanceId], Weight: 1}
+		}
+
+		// Without any readers the writer serves the reads
+		connections = append(connections, backends.ConnectionConfig{
+			Name: database.Identifier + "::reader",
+			LocalAddress: ":" + readerPort,
+			RemoteAddress: found.writer,
+			Targets: targets,
+			Url: readerPort + ":" + database.Identifier + ":reader",
+		})
+	}
+
+	for _, instanceId := range instanceIds {
+		port, ok := d.readerPorts[instanceId]
+
+		if !ok {
+			continue
+		}
+
+		connections = append(connections, backends.ConnectionConfig{
+			Name: database.Identifier + "::" + instanceId,
+			LocalAddress: ":" + strconv.Itoa(port),
+			RemoteAddress: found.readers[instanceId],
+			Url: strconv.Itoa(port) + ":" + database.Identifier + ":" + instanceId,
+		})
+	}
+
+	return connections
+}
+
+func (d *RdsBackend) describeCluster(identifier string) (*topology, error) {
+	clusters, err := d.rds.DescribeDBClusters(&rds.DescribeDBClustersInput{
+		DBClusterIdentifier: aws.String(identifier),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(clusters.DBClusters) != 1 {
+		return nil, fmt.Errorf("Cluster %s not found", identifier)
+	}
+
+	cluster := clusters.DBClusters[0]
+
+	instances, err := d.describeInstances(&rds.Filter{
+		Name: aws.String("db-cluster-id"),
+		Values: []*string{cluster.DBClusterIdentifier},
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	// The members know the writer straight away, the cluster endpoint only follows a failover through DNS
+	found := &topology{readers: make(map[string]string)}
+
+	for _, member := range cluster.DBClusterMembers {
+		address, ok := instances[aws.StringValue(member.DBInstanceIdentifier)]
+
+		if !ok {
+			continue
+		}
+
+		if aws.BoolValue(member.IsClusterWriter) {
+			found.writer = address
+		} else {
+			found.readers[aws.StringValue(member.DBInstanceIdentifier)] = address
+		}
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.writers == nil {
+		d.writers = make(map[string]string)
+	}
+
+	// While a failover leaves the cluster without an available writer, the last one is kept rather than
+	// retargeting the writer to the cluster endpoint, only to retarget it again to the new writer
+	switch last, ok := d.writers[identifier]; {
+	case found.writer != "":
+		d.writers[identifier] = found.writer
+	case ok:
+		found.writer = last
+	default:
+		found.writer = fmt.Sprintf("%s:%v", aws.StringValue(cluster.Endpoint), aws.Int64Value(cluster.Port))
+	}
+
+	return found, nil
+}
+
+func (d *RdsBackend) describeInstance(identifier string) (*topology, error) {
+	instances, err := d.rds.DescribeDBInstances(&rds.DescribeDBInstancesInput{
+		DBInstanceIdentifier: aws.String(identifier),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(instances.DBInstances) != 1 || instances.DBInstances[0].Endpoint == nil {
+		return nil, fmt.Errorf("Instance %s not found or not available", identifier)
+	}
+
+	instance := instances.DBInstances[0]
+
+	found := &topology{
+		writer: endpointAddress(instance.Endpoint),
+		readers: make(map[string]string),
+	}
+
+	if len(instance.ReadReplicaDBInstanceIdentifiers) == 0 {
+		return found, nil
+	}
+
+	found.readers, err = d.describeInstances(&rds.Filter{
+		Name: aws.String("db-instance-id"),
+		Values: instance.ReadReplicaDBInstanceIdentifiers,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return found, nil
+}
+
+// describeInstances returns the addresses of the available instances matching the filter, by instance id.
+func (d *RdsBackend) describeInstances(filter *rds.Filter) (map[string]string, error) {
+	addresses := make(map[string]string)
+
+	err := d.rds.DescribeDBInstancesPages(&rds.DescribeDBInstancesInput{
+		Filters: []*rds.Filter{filter},
+	}, func(page *rds.DescribeDBInstancesOutput, lastPage bool) bool {
+		for _, instance := range page.DBInstances {
+			if aws.StringValue(instance.DBInstanceStatus) == "available" && instance.Endpoint != nil {
+				addresses[aws.StringValue(instance.DBInstanceIdentifier)] = endpointAddress(instance.Endpoint)
+			}
+		}
+
+		return true
+	})
+
+	return addresses, err
+}
+
+func endpointAddress(endpoint *rds.Endpoint) string {
+	return fmt.Sprintf("%s:%v", aws.StringValue(endpoint.Address), aws.Int64Value(endpoint.Port))
+}
+
+func (b *RdsBackend) IsPollable() bool {
+	return true
+}
@@ -0,0 +1,179 @@
+package rds
+
+import (
+	"log/slog"
+	"testing"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
+	"github.com/brandnetworks/tcpproxy/backends"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockRds struct {
+	rdsiface.RDSAPI
+	clusters  []*rds.DBCluster
+	instances []*rds.DBInstance
+}
+
+func (m *mockRds) DescribeDBClusters(input *rds.DescribeDBClustersInput) (*rds.DescribeDBClustersOutput, error) {
+	output := &rds.DescribeDBClustersOutput{}
+
+	for _, cluster := range m.clusters {
+		if aws.StringValue(cluster.DBClusterIdentifier) == aws.StringValue(input.DBClusterIdentifier) {
+			output.DBClusters = append(output.DBClusters, cluster)
+		}
+	}
+
+	return output, nil
+}
+
+func (m *mockRds) DescribeDBInstances(input *rds.DescribeDBInstancesInput) (*rds.DescribeDBInstancesOutput, error) {
+	output := &rds.DescribeDBInstancesOutput{}
+
+	for _, instance := range m.instances {
+		if aws.StringValue(instance.DBInstanceIdentifier) == aws.StringValue(input.DBInstanceIdentifier) {
+			output.DBInstances = append(output.DBInstances, instance)
+		}
+	}
+
+	return output, nil
+}
+
+func (m *mockRds) DescribeDBInstancesPages(input *rds.DescribeDBInstancesInput, page func(*rds.DescribeDBInstancesOutput, bool) bool) error {
+	output := &rds.DescribeDBInstancesOutput{}
+	filter := input.Filters[0]
+
+	for _, instance := range m.instances {
+		for _, value := range filter.Values {
+			switch aws.StringValue(filter.Name) {
+			case "db-cluster-id":
+				if aws.StringValue(instance.DBClusterIdentifier) == aws.StringValue(value) {
+					output.DBInstances = append(output.DBInstances, instance)
+				}
+			case "db-instance-id":
+				if aws.StringValue(instance.DBInstanceIdentifier) == aws.StringValue(value) {
+					output.DBInstances = append(output.DBInstances, instance)
+				}
+			}
+		}
+	}
+
+	page(output, true)
+	return nil
+}
+
+func instance(cluster string, id string, status string) *rds.DBInstance {
+	return &rds.DBInstance{
+		DBClusterIdentifier:  aws.String(cluster),
+		DBInstanceIdentifier: aws.String(id),
+		DBInstanceStatus:     aws.String(status),
+		Endpoint:             &rds.Endpoint{Address: aws.String(id + ".rds"), Port: aws.Int64(5432)},
+	}
+}
+
+func member(id string, writer bool) *rds.DBClusterMember {
+	return &rds.DBClusterMember{DBInstanceIdentifier: aws.String(id), IsClusterWriter: aws.Bool(writer)}
+}
+
+func auroraCluster(members ...*rds.DBClusterMember) []*rds.DBCluster {
+	return []*rds.DBCluster{{
+		DBClusterIdentifier: aws.String("orders"),
+		Endpoint:            aws.String("orders.cluster.rds"),
+		Port:                aws.Int64(5432),
+		DBClusterMembers:    members,
+	}}
+}
+
+func TestParseDatabases(t *testing.T) {
+	databases, err := ParseDatabases("cluster:orders:5432:5433,instance:billing:5434")
+
+	assert.Nil(t, err)
+	assert.Equal(t, []Database{
+		{Identifier: "orders", Cluster: true, WriterPort: 5432, ReaderPort: 5433},
+		{Identifier: "billing", Cluster: false, WriterPort: 5434},
+	}, databases)
+
+	_, err = ParseDatabases("replica:orders:5432")
+	assert.NotNil(t, err)
+
+	_, err = ParseDatabases("cluster:orders:writer")
+	assert.NotNil(t, err)
+}
+
+func TestClusterWriterAndReaders(t *testing.T) {
+	mock := &mockRds{
+		clusters: auroraCluster(member("orders-1", true), member("orders-2", false), member("orders-3", false)),
+		instances: []*rds.DBInstance{
+			instance("orders", "orders-1", "available"),
+			instance("orders", "orders-2", "available"),
+			instance("orders", "orders-3", "rebooting"),
+		},
+	}
+
+	backend := &RdsBackend{
+		logger:      slog.New(slog.DiscardHandler),
+		databases:   []Database{{Identifier: "orders", Cluster: true, WriterPort: 5432, ReaderPort: 5433}},
+		readerPorts: map[string]int{"orders-2": 6002},
+		rds:         mock,
+	}
+
+	connections, err := backend.GetProxyConfigurations()
+
+	assert.Nil(t, err)
+	assert.Len(t, connections, 3)
+	assert.Equal(t, "5432:orders:writer", connections[0].Url)
+	assert.Equal(t, "orders-1.rds:5432", connections[0].RemoteAddress)
+	assert.True(t, connections[0].EndSessionsOnRetarget)
+	assert.Equal(t, "5433:orders:reader", connections[1].Url)
+	assert.False(t, connections[1].EndSessionsOnRetarget)
+	assert.Equal(t, []backends.Target{{Address: "orders-2.rds:5432", Weight: 1}}, connections[1].Upstreams())
+	assert.Equal(t, ":6002", connections[2].LocalAddress)
+	assert.Equal(t, "orders-2.rds:5432", connections[2].RemoteAddress)
+
+	// After a failover the writer keeps its url with the new endpoint
+	mock.clusters = auroraCluster(member("orders-1", false), member("orders-2", true), member("orders-3", false))
+
+	connections, err = backend.GetProxyConfigurations()
+
+	assert.Nil(t, err)
+	assert.Len(t, connections, 2)
+	assert.Equal(t, "5432:orders:writer", connections[0].Url)
+	assert.Equal(t, "orders-2.rds:5432", connections[0].RemoteAddress)
+	assert.Equal(t, []backends.Target{{Address: "orders-1.rds:5432", Weight: 1}}, connections[1].Upstreams())
+
+	// While the next failover leaves no writer available the last one is kept, rather than the cluster endpoint
+	mock.clusters = auroraCluster(member("orders-1", true), member("orders-2", false), member("orders-3", false))
+	mock.instances[0] = instance("orders", "orders-1", "rebooting")
+
+	connections, err = backend.GetProxyConfigurations()
+
+	assert.Nil(t, err)
+	assert.Equal(t, "orders-2.rds:5432", connections[0].RemoteAddress)
+
+	// A cluster never seen with a writer starts out on the cluster endpoint
+	backend.writers = nil
+
+	connections, err = backend.GetProxyConfigurations()
+
+	assert.Nil(t, err)
+	assert.Equal(t, "orders.cluster.rds:5432", connections[0].RemoteAddress)
+}
+
+func TestInstanceWithReplicas(t *testing.T) {
+	primary := instance("", "billing", "available")
+	primary.ReadReplicaDBInstanceIdentifiers = []*string{aws.String("billing-replica")}
+
+	backend := &RdsBackend{
+		logger:    slog.New(slog.DiscardHandler),
+		databases: []Database{{Identifier: "billing", WriterPort: 5434, ReaderPort: 5435}},
+		rds:       &mockRds{instances: []*rds.DBInstance{primary, instance("", "billing-replica", "available")}},
+	}
+
+	connections, err := backend.GetProxyConfigurations()
+
+	assert.Nil(t, err)
+	assert.Len(t, connections, 2)
+	assert.Equal(t, "billing.rds:5432", connections[0].RemoteAddress)
+	assert.Equal(t, []backends.Target{{Address: "billing-replica.rds:5432", Weight: 1}}, connections[1].Upstreams())
+}
@@ -0,0 +1,150 @@
+package srv
+
+import (
+	"context"
+	"github.com/brandnetworks/tcpproxy/backends"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"fmt"
+	"log/slog"
+)
+
+const lookupTimeout = 10 * time.Second
+
+// A SRV record to resolve, proxied on the local port.
+type Record struct {
+	Name      string
+	LocalPort int
+}
+
+// ParseRecords parses a comma separated list of localPort:name pairs, e.g. 5432:_postgres._tcp.db.example.com
+func ParseRecords(recordsArg string) ([]Record, error) {
+	if len(recordsArg) == 0 {
+		return nil, fmt.Errorf("Records must not be empty")
+	}
+
+	recordArgs := strings.Split(recordsArg, ",")
+	records := make([]Record, len(recordArgs))
+
+	for i, recordArg := range recordArgs {
+		parts := strings.SplitN(recordArg, ":", 2)
+
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("A record must have two parts: localPort:name '%s'", recordArg)
+		}
+
+		port, err := strconv.Atoi(parts[0])
+
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("Invalid local port '%s' for record %s", parts[0], parts[1])
+		}
+
+		records[i] = Record{Name: parts[1], LocalPort: port}
+	}
+
+	return records, nil
+}
+
+// CreateSrvBackend resolves the records on each poll, through dnsServer when it isn't empty
+// rather than the system resolver.
+func CreateSrvBackend(logger *slog.Logger, records []Record, dnsServer string) *SrvBackend {
+	resolver := net.DefaultResolver
+
+	if dnsServer != "" {
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network string, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, dnsServer)
+			},
+		}
+	}
+
+	return &SrvBackend{
+		logger: logger,
+		records: records,
+		resolver: resolver,
+	}
+}
+
+type SrvBackend struct {
+	logger *slog.Logger
+	records []Record
+	resolver *net.Resolver
+}
+
+func (d *SrvBackend) GetProxyConfigurations() ([]backends.ConnectionConfig, error) {
+	connections := make([]backends.ConnectionConfig, 0, len(d.records))
+
+	for _, record := range d.records {
+		targets, err := d.lookup(record.Name)
+
+		if err != nil {
+			d.logger.Error("Error resolving SRV record", "record", record.Name, "error", err)
+			return nil, err
+		}
+
+		d.logger.Debug("Resolved SRV record", "record", record.Name, "targets", len(targets))
+
+		if len(targets) == 0 {
+			continue
+		}
+
+		localPort := strconv.Itoa(record.LocalPort)
+
+		// The url names the record rather than its targets, so changes to them update the connection in place
+		connections = append(connections, backends.ConnectionConfig{
+			Name: record.Name,
+			LocalAddress: ":" + localPort,
+			RemoteAddress: targets[0].Address,
+			Targets: targets,
+			Url: localPort + ":" + record.Name + ":srv",
+		})
+	}
+
+	return connections, nil
+}
+
+func (d *SrvBackend) lookup(name string) ([]backends.Target, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+
+	_, records, err := d.resolver.LookupSRV(ctx, "", "", name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make([]backends.Target, 0, len(records))
+
+	for _, record := range records {
+		// A lone "." target means the service is decidedly not available
+		if record.Target == "." {
+			continue
+		}
+
+		targets = append(targets, backends.Target{
+			Address: net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port))),
+			Priority: int(record.Priority),
+			Weight: int(record.Weight),
+		})
+	}
+
+	// The resolver shuffles records by weight, the proxy does that per session instead
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].Priority != targets[j].Priority {
+			return targets[i].Priority < targets[j].Priority
+		}
+
+		return targets[i].Address < targets[j].Address
+	})
+
+	return targets, nil
+}
+
+func (b *SrvBackend) IsPollable() bool {
+	return true
+}
@@ -0,0 +1,153 @@
+package srv
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"github.com/brandnetworks/tcpproxy/backends"
+	"github.com/stretchr/testify/assert"
+)
+
+const typeSRV = 33
+
+// stubDNS answers SRV queries for the records it knows, and NXDOMAIN for everything else.
+func stubDNS(t *testing.T, records map[string][]net.SRV) (string, func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		buffer := make([]byte, 512)
+
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+
+			if response := answer(buffer[:n], records); response != nil {
+				conn.WriteTo(response, addr)
+			}
+		}
+	}()
+
+	return conn.LocalAddr().String(), func() { conn.Close() }
+}
+
+func encodeName(name string) []byte {
+	encoded := make([]byte, 0, len(name) + 2)
+
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		encoded = append(encoded, byte(len(label)))
+		encoded = append(encoded, label...)
+	}
+
+	return append(encoded, 0)
+}
+
+func answer(query []byte, records map[string][]net.SRV) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+
+	// Walk the labels of the question name
+	offset := 12
+	labels := make([]string, 0)
+
+	for offset < len(query) && query[offset] != 0 {
+		length := int(query[offset])
+		labels = append(labels, string(query[offset + 1:offset + 1 + length]))
+		offset += length + 1
+	}
+
+	questionEnd := offset + 5
+	qtype := binary.BigEndian.Uint16(query[offset + 1:])
+	found, ok := records[strings.ToLower(strings.Join(labels, "."))]
+
+	response := make([]byte, 12, 512)
+	copy(response, query[:2])
+
+	flags := uint16(0x8180)
+	if !ok {
+		flags |= 3
+	}
+
+	answers := 0
+	if ok && qtype == typeSRV {
+		answers = len(found)
+	}
+
+	binary.BigEndian.PutUint16(response[2:], flags)
+	binary.BigEndian.PutUint16(response[4:], 1)
+	binary.BigEndian.PutUint16(response[6:], uint16(answers))
+	response = append(response, query[12:questionEnd]...)
+
+	for i := 0; i < answers; i++ {
+		target := encodeName(found[i].Target)
+		data := make([]byte, 6, 6 + len(target))
+		binary.BigEndian.PutUint16(data[0:], found[i].Priority)
+		binary.BigEndian.PutUint16(data[2:], found[i].Weight)
+		binary.BigEndian.PutUint16(data[4:], found[i].Port)
+		data = append(data, target...)
+
+		record := []byte{0xc0, 12, 0, typeSRV, 0, 1, 0, 0, 0, 60, 0, 0}
+		binary.BigEndian.PutUint16(record[10:], uint16(len(data)))
+		response = append(response, record...)
+		response = append(response, data...)
+	}
+
+	return response
+}
+
+func TestParseRecords(t *testing.T) {
+	records, err := ParseRecords("5432:_postgres._tcp.db.example.com,6379:_redis._tcp.cache.example.com")
+
+	assert.Nil(t, err)
+	assert.Equal(t, []Record{
+		{Name: "_postgres._tcp.db.example.com", LocalPort: 5432},
+		{Name: "_redis._tcp.cache.example.com", LocalPort: 6379},
+	}, records)
+
+	_, err = ParseRecords("_postgres._tcp.db.example.com")
+	assert.NotNil(t, err)
+}
+
+func TestResolveRecords(t *testing.T) {
+	server, stop := stubDNS(t, map[string][]net.SRV{
+		"_postgres._tcp.db.example.com": {
+			{Target: "db3.example.com.", Port: 5432, Priority: 20, Weight: 0},
+			{Target: "db2.example.com.", Port: 5433, Priority: 10, Weight: 30},
+			{Target: "db1.example.com.", Port: 5432, Priority: 10, Weight: 70},
+		},
+	})
+	defer stop()
+
+	backend := CreateSrvBackend(slog.New(slog.DiscardHandler), []Record{{Name: "_postgres._tcp.db.example.com", LocalPort: 15432}}, server)
+
+	connections, err := backend.GetProxyConfigurations()
+
+	assert.Nil(t, err)
+	assert.Len(t, connections, 1)
+	assert.Equal(t, ":15432", connections[0].LocalAddress)
+	assert.Equal(t, "15432:_postgres._tcp.db.example.com:srv", connections[0].Url)
+	assert.Equal(t, []backends.Target{
+		{Address: "db1.example.com:5432", Priority: 10, Weight: 70},
+		{Address: "db2.example.com:5433", Priority: 10, Weight: 30},
+		{Address: "db3.example.com:5432", Priority: 20, Weight: 0},
+	}, connections[0].Upstreams())
+	assert.Nil(t, connections[0].Validate())
+}
+
+func TestResolveMissingRecord(t *testing.T) {
+	server, stop := stubDNS(t, map[string][]net.SRV{})
+	defer stop()
+
+	backend := CreateSrvBackend(slog.New(slog.DiscardHandler), []Record{{Name: "_postgres._tcp.missing.example.com", LocalPort: 15432}}, server)
+
+	_, err := backend.GetProxyConfigurations()
+
+	assert.NotNil(t, err)
+}
@@ -1,24 +1,104 @@
 package static
 
 import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
 	"github.com/brandnetworks/tcpproxy/backends"
 )
 
 func CreateStaticBackend(connectionsArgument string) (*StaticBackend, error) {
-	connections, err := backends.ParseConnectionsParameter(connectionsArgument)
+	backend := &StaticBackend{ argument: connectionsArgument }
 
-	if err != nil {
+	if err := backend.Reload(); err != nil {
+		return nil, err
+	}
+
+	return backend, nil
+}
+
+// CreateStaticFileBackend proxies the connections listed in a file, read again on Reload. The file holds the same
+// srcPort:destHost:destPort entries as --connections, one per line or comma separated, with # starting a comment.
+func CreateStaticFileBackend(path string) (*StaticBackend, error) {
+	backend := &StaticBackend{ path: path }
+
+	if err := backend.Reload(); err != nil {
 		return nil, err
-	} else {
-		return &StaticBackend{ connectionsConfig: connections }, nil
 	}
+
+	return backend, nil
 }
 
 type StaticBackend struct {
+	argument string
+	path string
+
+	lock sync.Mutex
 	connectionsConfig []backends.ConnectionConfig
 }
 
+// Reload parses the connections again, so an edited file applies without restarting.
+func (b *StaticBackend) Reload() error {
+	argument := b.argument
+
+	if b.path != "" {
+		contents, err := ioutil.ReadFile(b.path)
+
+		if err != nil {
+			return err
+		}
+
+		argument = parseFile(string(contents))
+
+		if argument == "" {
+			return fmt.Errorf("No connections in %s", b.path)
+		}
+	}
+
+	connections, err := backends.ParseConnectionsParameter(argument)
+
+	if err != nil {
+		return err
+	}
+
+	for i := range connections {
+		if err := connections[i].Validate(); err != nil {
+			return err
+		}
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.connectionsConfig = connections
+
+	return nil
+}
+
+// parseFile joins the entries of a connections file into a --connections argument.
+func parseFile(contents string) string {
+	entries := make([]string, 0)
+
+	for _, line := range strings.Split(contents, "\n") {
+		if comment := strings.Index(line, "#"); comment >= 0 {
+			line = line[:comment]
+		}
+
+		for _, entry := range strings.Split(line, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				entries = append(entries, entry)
+			}
+		}
+	}
+
+	return strings.Join(entries, ",")
+}
+
 func (b *StaticBackend) GetProxyConfigurations() ([]backends.ConnectionConfig, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
 	return b.connectionsConfig, nil
 }
 
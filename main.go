@@ -2,30 +2,87 @@ package main
 
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"os"
-	"log"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 	"flag"
+	"log/slog"
 	"strings"
+	"net"
 	"net/http"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/brandnetworks/tcpproxy/web"
+	"github.com/brandnetworks/tcpproxy/accesslog"
+	"github.com/brandnetworks/tcpproxy/notify"
 	"github.com/brandnetworks/tcpproxy/proxy"
 	"github.com/brandnetworks/tcpproxy/backends"
 	"github.com/brandnetworks/tcpproxy/backends/static"
+	"github.com/brandnetworks/tcpproxy/backends/composite"
+	"github.com/brandnetworks/tcpproxy/backends/consul"
 	"github.com/brandnetworks/tcpproxy/backends/dynamodb"
+	"github.com/brandnetworks/tcpproxy/backends/ec2"
 	"github.com/brandnetworks/tcpproxy/backends/elasticache"
+	"github.com/brandnetworks/tcpproxy/backends/httpjson"
+	"github.com/brandnetworks/tcpproxy/backends/rds"
+	"github.com/brandnetworks/tcpproxy/backends/srv"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 type TcpProxyArgs struct {
 	htmlEndpointBind *string
+	statusTokensFile *string
+	statusCertFile *string
+	statusKeyFile *string
+	statusClientCAFile *string
+	statusReadClients *string
+	statusAdminClients *string
+	statusAnonymous *bool
 	logLevel *int
+	logLevelName *string
+	logFormat *string
 	awsRegion *string
 	backend *string
 	proxyName *string
+	snapshotPath *string
+	guardPercent *int
+	guardPolls *int
+	webhooks *string
+	accessLogPath *string
+	accessLogFormat *string
+	otlpEndpoint *string
+	shutdownTimeout *time.Duration
+	shutdownDelay *time.Duration
 	staticConnectionsConfigurationList *string
+	staticConnectionsFile *string
 	dynamodbTableName *string
 	elasticacheClusterID *string
 	elasticacheClusterLocalPort *int
+	elasticacheReplicationGroupID *string
+	elasticacheReaderLocalPort *int
+	elasticacheAllNodes *bool
+	elasticacheNodePorts *string
+	rdsDatabases *string
+	rdsReaderPorts *string
+	ec2Tags *string
+	ec2LocalPort *int
+	ec2RemotePort *int
+	srvRecords *string
+	srvDNSServer *string
+	consulAddress *string
+	consulDatacenter *string
+	consulServices *string
+	httpURL *string
+	httpAuthHeader *string
+	httpSignatureHeader *string
 }
 
 type TcpProxyError struct {
@@ -37,21 +94,155 @@ func NewTcpProxyError(msg string) (*TcpProxyError) {
 	return &TcpProxyError{msg: msg}
 }
 
-func GetBackend(args TcpProxyArgs) (backends.ReadOnly, error) {
-	switch strings.ToLower(*args.backend) {
+// GetLogger logs at --log-level in the --log-format, a --debug above 0 still turns on debug logging.
+func GetLogger(args TcpProxyArgs, out io.Writer) (*slog.Logger, error) {
+	var level slog.Level
+
+	if err := level.UnmarshalText([]byte(*args.logLevelName)); err != nil {
+		return nil, NewTcpProxyError("Error: unrecognised log level, use one of 'debug', 'info', 'warn' or 'error'.")
+	}
+
+	if *args.logLevel > 0 {
+		level = slog.LevelDebug
+	}
+
+	options := &slog.HandlerOptions{Level: level}
+
+	switch strings.ToLower(*args.logFormat) {
+	case "logfmt", "text":
+		return slog.New(slog.NewTextHandler(out, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(out, options)), nil
+	default:
+		return nil, NewTcpProxyError("Error: unrecognised log format, use 'logfmt' or 'json'.")
+	}
+}
+
+// GetTracerProvider exports spans over OTLP/HTTP to --otlp-endpoint, or to the endpoint of the standard
+// OTEL_EXPORTER_OTLP_ENDPOINT variables. It returns nil when neither is set, leaving tracing off.
+func GetTracerProvider(args TcpProxyArgs) (*sdktrace.TracerProvider, error) {
+	options := make([]otlptracehttp.Option, 0)
+
+	if *args.otlpEndpoint != "" {
+		options = append(options, otlptracehttp.WithEndpointURL(*args.otlpEndpoint))
+	} else if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return nil, nil
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	attributes := []attribute.KeyValue{attribute.String("service.name", "tcpproxy")}
+
+	if *args.proxyName != "" {
+		attributes = append(attributes, attribute.String("service.instance.id", *args.proxyName))
+	}
+
+	// OTEL_RESOURCE_ATTRIBUTES and OTEL_SERVICE_NAME still override these
+	defaults, err := resource.Merge(resource.Default(), resource.NewSchemaless(attributes...))
+
+	if err != nil {
+		return nil, err
+	}
+
+	environment, err := resource.New(context.Background(), resource.WithFromEnv())
+
+	if err != nil {
+		return nil, err
+	}
+
+	merged, err := resource.Merge(defaults, environment)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(merged)), nil
+}
+
+// RegisterBackendFlags registers the flags configuring the backends, shared by the proxy and the routes command.
+func RegisterBackendFlags(flags *flag.FlagSet, args *TcpProxyArgs) {
+	args.awsRegion = flags.String("region", "us-east-1", "The AWS region in which the DynamoDB instance is located")
+
+	args.staticConnectionsConfigurationList = flags.String("connections", "", "Comma separated list: srcPort:destHost:destPort,srcPort2:destHost2:destPort2")
+	args.staticConnectionsFile = flags.String("connections-file", "", "File listing the connections like --connections, one per line, read again on SIGHUP")
+	args.dynamodbTableName = flags.String("dynamodb", "classic-proxy", "This flag indicates the table on which the application operates, it must already exist")
+	args.elasticacheClusterID = flags.String("elasticache-cluster-id", "", "This flag indicates the id of the Elasticache Cluster for which this program should proxy")
+	args.elasticacheClusterLocalPort = flags.Int("elasticache-port", -1, "The local port from which the selected elasticache instance is proxied")
+	args.elasticacheReplicationGroupID = flags.String("elasticache-replication-group-id", "", "This flag indicates the id of the Elasticache Replication Group whose primary this program should proxy")
+	args.elasticacheAllNodes = flags.Bool("elasticache-all-nodes", false, "Proxy every node of the cluster, node 0001 on --elasticache-port, 0002 on the next port and so on")
+	args.elasticacheNodePorts = flags.String("elasticache-node-ports", "", "Comma separated nodeId:localPort list overriding the port of nodes with --elasticache-all-nodes")
+	args.elasticacheReaderLocalPort = flags.Int("elasticache-reader-port", -1, "The local port balancing across the replicas of the replication group, disabled by default")
+
+	args.rdsDatabases = flags.String("rds", "", "Comma separated list: cluster|instance:identifier:writerPort[:readerPort]")
+	args.rdsReaderPorts = flags.String("rds-reader-ports", "", "Comma separated instanceId:localPort list proxying individual readers")
+
+	args.ec2Tags = flags.String("ec2-tags", "", "Comma separated key=value list of tags the proxied instances must all carry")
+	args.ec2LocalPort = flags.Int("ec2-port", -1, "The local port balanced across the tagged instances")
+	args.ec2RemotePort = flags.Int("ec2-remote-port", -1, "The port the tagged instances listen on")
+
+	args.srvRecords = flags.String("srv", "", "Comma separated list: localPort:_service._proto.name")
+	args.srvDNSServer = flags.String("srv-dns-server", "", "Address:port of the DNS server resolving the SRV records, defaults to the system resolver")
+
+	args.consulAddress = flags.String("consul-address", "http://127.0.0.1:8500", "The URL of the Consul HTTP API")
+	args.consulDatacenter = flags.String("consul-datacenter", "", "The Consul datacenter of the services, defaults to the agent's")
+	args.consulServices = flags.String("consul", "", "Comma separated list: localPort:service")
+
+	args.httpURL = flags.String("http-url", "", "The HTTP(S) URL serving the routes as JSON")
+	args.httpAuthHeader = flags.String("http-auth-header", "Authorization", "The header carrying the value of TCPPROXY_HTTP_AUTH when fetching the routes")
+	args.httpSignatureHeader = flags.String("http-signature-header", "X-Signature", "The header carrying the HMAC of the routes when TCPPROXY_HTTP_SIGNING_KEY is set")
+}
+
+// GetBackend creates the backend named by --backend, or merges several of them given a comma separated list.
+func GetBackend(logger *slog.Logger, args TcpProxyArgs) (backends.ReadOnly, error) {
+	names := strings.Split(*args.backend, ",")
+
+	if len(names) == 1 {
+		return GetNamedBackend(logger, names[0], args)
+	}
+
+	sources := make([]composite.Source, len(names))
+
+	for i, name := range names {
+		backend, err := GetNamedBackend(logger.With("source", name), name, args)
+
+		if err != nil {
+			return nil, err
+		}
+
+		// Backends listed first take precedence when two of them use the same local port
+		sources[i] = composite.Source{Name: name, Priority: len(names) - i, Backend: backend}
+	}
+
+	return composite.CreateManageableCompositeBackend(logger, sources)
+}
+
+func GetNamedBackend(logger *slog.Logger, name string, args TcpProxyArgs) (backends.ReadOnly, error) {
+	switch strings.ToLower(name) {
 	case "static":
-		if *args.staticConnectionsConfigurationList != "" {
-			log.Println("Proxying CLI configurations...")
+		if *args.staticConnectionsConfigurationList != "" && *args.staticConnectionsFile != "" {
+			return nil, NewTcpProxyError("Error: --connections and --connections-file are exclusive.")
+
+		} else if *args.staticConnectionsConfigurationList != "" {
+			logger.Info("Proxying CLI configurations")
 
 			return static.CreateStaticBackend(*args.staticConnectionsConfigurationList)
 
+		} else if *args.staticConnectionsFile != "" {
+			logger.Info("Proxying file configurations", "path", *args.staticConnectionsFile)
+
+			return static.CreateStaticFileBackend(*args.staticConnectionsFile)
+
 		} else {
 			return nil, NewTcpProxyError("Error: No connection configuations specified.")
 		}
 
 	case "dynamodb":
 		if *args.proxyName != "" {
-			log.Println("Proxying configurations from dynamodb...")
+			logger.Info("Proxying configurations from dynamodb")
 
 			awsConfig := &aws.Config{Region: aws.String(*args.awsRegion), MaxRetries: aws.Int(15)}
 
@@ -64,18 +255,42 @@ func GetBackend(args TcpProxyArgs) (backends.ReadOnly, error) {
 		}
 
 	case "elasticache":
-		if  *args.elasticacheClusterID != "" && *args.elasticacheClusterLocalPort > 0 {
-			log.Println("Proxying configurations from elasticache...")
+		if *args.elasticacheReplicationGroupID != "" && *args.elasticacheClusterLocalPort > 0 {
+			logger.Info("Proxying replication group from elasticache")
+
+			awsConfig := &aws.Config{Region: aws.String(*args.awsRegion), MaxRetries: aws.Int(15)}
+
+			backend := elasticache.CreateElasticacheReplicationGroupBackend(logger, *args.elasticacheReplicationGroupID, *args.elasticacheClusterLocalPort, *args.elasticacheReaderLocalPort, awsConfig)
+
+			return backend, nil
+
+		} else if *args.elasticacheClusterID != "" && *args.elasticacheAllNodes && (*args.elasticacheClusterLocalPort > 0 || *args.elasticacheNodePorts != "") {
+			logger.Info("Proxying every node of the cluster from elasticache")
+
+			nodePorts, err := elasticache.ParseNodePorts(*args.elasticacheNodePorts)
+
+			if err != nil {
+				return nil, err
+			}
+
+			awsConfig := &aws.Config{Region: aws.String(*args.awsRegion), MaxRetries: aws.Int(15)}
+
+			backend := elasticache.CreateElasticacheAllNodesBackend(logger, *args.elasticacheClusterID, *args.elasticacheClusterLocalPort, nodePorts, awsConfig)
+
+			return backend, nil
+
+		} else if *args.elasticacheClusterID != "" && *args.elasticacheClusterLocalPort > 0 {
+			logger.Info("Proxying configurations from elasticache")
 
 			awsConfig := &aws.Config{Region: aws.String(*args.awsRegion), MaxRetries: aws.Int(15)}
 
-			backend := elasticache.CreateElasticacheBackend(*args.logLevel, *args.elasticacheClusterID, *args.elasticacheClusterLocalPort, awsConfig)
+			backend := elasticache.CreateElasticacheBackend(logger, *args.elasticacheClusterID, *args.elasticacheClusterLocalPort, awsConfig)
 
 			return backend, nil
 
 		} else {
-			if *args.elasticacheClusterID == "" {
-				return nil, NewTcpProxyError("Error: No Elasticache Cluster specified, please provide one for this backend.")
+			if *args.elasticacheClusterID == "" && *args.elasticacheReplicationGroupID == "" {
+				return nil, NewTcpProxyError("Error: No Elasticache Cluster or Replication Group specified, please provide one for this backend.")
 			}
 
 			if *args.elasticacheClusterLocalPort < 0 {
@@ -86,62 +301,450 @@ func GetBackend(args TcpProxyArgs) (backends.ReadOnly, error) {
 			return nil, NewTcpProxyError("Error: Unrecognised error initialising the elasticache backend.")
 		}
 
+	case "rds":
+		if *args.rdsDatabases != "" {
+			logger.Info("Proxying configurations from rds")
+
+			databases, err := rds.ParseDatabases(*args.rdsDatabases)
+
+			if err != nil {
+				return nil, err
+			}
+
+			readerPorts, err := rds.ParseReaderPorts(*args.rdsReaderPorts)
+
+			if err != nil {
+				return nil, err
+			}
+
+			awsConfig := &aws.Config{Region: aws.String(*args.awsRegion), MaxRetries: aws.Int(15)}
+
+			backend := rds.CreateRdsBackend(logger, databases, readerPorts, awsConfig)
+
+			return backend, nil
+
+		} else {
+			return nil, NewTcpProxyError("Error: No RDS databases specified, please provide some for this backend.")
+		}
+
+	case "ec2":
+		if *args.ec2Tags != "" && *args.ec2LocalPort > 0 && *args.ec2RemotePort > 0 {
+			logger.Info("Proxying tagged instances from ec2")
+
+			tags, err := ec2.ParseTags(*args.ec2Tags)
+
+			if err != nil {
+				return nil, err
+			}
+
+			awsConfig := &aws.Config{Region: aws.String(*args.awsRegion), MaxRetries: aws.Int(15)}
+
+			backend := ec2.CreateEc2Backend(logger, tags, *args.ec2LocalPort, *args.ec2RemotePort, awsConfig)
+
+			return backend, nil
+
+		} else {
+			return nil, NewTcpProxyError("Error: The ec2 backend needs --ec2-tags, --ec2-port and --ec2-remote-port.")
+		}
+
+	case "srv":
+		if *args.srvRecords != "" {
+			logger.Info("Proxying SRV records")
+
+			records, err := srv.ParseRecords(*args.srvRecords)
+
+			if err != nil {
+				return nil, err
+			}
+
+			return srv.CreateSrvBackend(logger, records, *args.srvDNSServer), nil
+
+		} else {
+			return nil, NewTcpProxyError("Error: No SRV records specified, please provide some for this backend.")
+		}
+
+	case "consul":
+		if *args.consulServices != "" {
+			logger.Info("Proxying services from consul")
+
+			services, err := consul.ParseServices(*args.consulServices)
+
+			if err != nil {
+				return nil, err
+			}
+
+			// Read from the environment like the consul cli does, rather than a flag showing up in ps
+			token := os.Getenv("CONSUL_HTTP_TOKEN")
+
+			return consul.CreateConsulBackend(logger, *args.consulAddress, token, *args.consulDatacenter, services), nil
+
+		} else {
+			return nil, NewTcpProxyError("Error: No Consul services specified, please provide some for this backend.")
+		}
+
+	case "http":
+		if *args.httpURL != "" {
+			logger.Info("Proxying configurations from an HTTP URL", "url", *args.httpURL)
+
+			// Secrets come from the environment rather than flags showing up in ps
+			authHeaderValue := os.Getenv("TCPPROXY_HTTP_AUTH")
+			signingKey := os.Getenv("TCPPROXY_HTTP_SIGNING_KEY")
+
+			return httpjson.CreateHttpJsonBackend(logger, *args.httpURL, *args.httpAuthHeader, authHeaderValue, *args.httpSignatureHeader, signingKey), nil
+
+		} else {
+			return nil, NewTcpProxyError("Error: No URL specified, please provide one for this backend.")
+		}
+
 	default:
 		return nil, NewTcpProxyError("Error: unrecognised backend chosen.")
 	}
 }
 
+func GetAuth(args TcpProxyArgs) (*web.Auth, error) {
+	auth := web.CreateAuth(*args.statusAnonymous)
+
+	if *args.statusTokensFile != "" {
+		if err := auth.LoadTokens(*args.statusTokensFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if *args.statusClientCAFile == "" && (*args.statusReadClients != "" || *args.statusAdminClients != "") {
+		return nil, NewTcpProxyError("Error: Client certificate access needs a --status-client-ca.")
+	}
+
+	for _, client := range strings.Split(*args.statusReadClients, ",") {
+		if client != "" {
+			auth.AddClient(client, web.RoleRead)
+		}
+	}
+
+	for _, client := range strings.Split(*args.statusAdminClients, ",") {
+		if client != "" {
+			auth.AddClient(client, web.RoleAdmin)
+		}
+	}
+
+	return auth, nil
+}
+
+// CreateStatusServer serves handler on the status address, over TLS when --status-cert is set.
+func CreateStatusServer(args TcpProxyArgs, handler http.Handler) (*http.Server, error) {
+	server := &http.Server{Addr: *args.htmlEndpointBind, Handler: handler}
+
+	if *args.statusCertFile == "" {
+		if *args.statusClientCAFile != "" {
+			return nil, NewTcpProxyError("Error: --status-client-ca needs --status-cert and --status-key.")
+		}
+
+		return server, nil
+	}
+
+	tlsConfig, err := web.ServerTLSConfig(*args.statusClientCAFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	server.TLSConfig = tlsConfig
+
+	return server, nil
+}
+
+// ServeStatus blocks until the status server is shut down, which isn't an error.
+func ServeStatus(args TcpProxyArgs, server *http.Server, listener net.Listener) error {
+	var err error
+
+	if *args.statusCertFile == "" {
+		err = server.Serve(listener)
+	} else {
+		err = server.ServeTLS(listener, *args.statusCertFile, *args.statusKeyFile)
+	}
+
+	if err == http.ErrServerClosed {
+		return nil
+	}
+
+	return err
+}
+
+// stop drains the proxy, then shuts the status server down within the timeout. Shutting the status
+// server down returns from Run, and so from main.
+func stop(logger *slog.Logger, drain func(context.Context) error, server *http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := drain(ctx); err != nil {
+		logger.Warn("Sessions closed before they ended", "error", err)
+	}
+
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Warn("Error shutting down the status endpoint", "error", err)
+		server.Close()
+	}
+}
+
+// ShutdownOnSignal shuts the proxy, then the status server down on SIGTERM or SIGINT, giving the sessions
+// until the timeout to end.
+func ShutdownOnSignal(logger *slog.Logger, proxyServer *proxy.Server, server *http.Server, timeout time.Duration) {
+	terminate := make(chan os.Signal, 1)
+	signal.Notify(terminate, syscall.SIGTERM, os.Interrupt)
+
+	go func() {
+		received := <-terminate
+		logger.Info("Received signal, shutting down", "signal", received.String(), "timeout", timeout)
+
+		stop(logger, proxyServer.Shutdown, server, timeout)
+	}()
+}
+
+// CreateUpgrade returns a function starting the binary this process runs, now maybe a newer version, on the
+// listeners of the proxy and the status endpoint. Once the new process is ready this one drains and exits.
+func CreateUpgrade(logger *slog.Logger, args TcpProxyArgs, proxyServer *proxy.Server, server *http.Server, statusListener net.Listener, timeout time.Duration) func() (int, error) {
+	var lock sync.Mutex
+	upgraded := false
+
+	return func() (int, error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if upgraded {
+			return 0, NewTcpProxyError("Error: already upgraded, this process is draining.")
+		}
+
+		listeners := proxyServer.Proxy().Listeners()
+		listeners[*args.htmlEndpointBind] = statusListener
+
+		process, err := proxy.StartUpgrade(logger, os.Args, listeners)
+
+		if err != nil {
+			return 0, err
+		}
+
+		upgraded = true
+		logger.Info("Upgraded, draining", "pid", process.Pid, "timeout", timeout)
+
+		go stop(logger, proxyServer.Proxy().Drain, server, timeout)
+
+		return process.Pid, nil
+	}
+}
+
+// ReloadOnSignal reopens the access log, when there is one, and reloads the connections on SIGHUP.
+func ReloadOnSignal(logger *slog.Logger, proxyServer *proxy.Server, accessLog *accesslog.AccessLog) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	go func() {
+		for range hangup {
+			if accessLog != nil {
+				if err := accessLog.Reopen(); err != nil {
+					logger.Error("Error reopening the access log", "error", err)
+				}
+			}
+
+			// Logged and published as a config_reloaded event by the proxy
+			proxyServer.Reload()
+		}
+	}()
+}
+
+// UpgradeOnSignal upgrades on SIGUSR2.
+func UpgradeOnSignal(logger *slog.Logger, upgrade func() (int, error)) {
+	upgrades := make(chan os.Signal, 1)
+	signal.Notify(upgrades, syscall.SIGUSR2)
+
+	go func() {
+		for range upgrades {
+			if _, err := upgrade(); err != nil {
+				logger.Error("Error upgrading", "error", err)
+			}
+		}
+	}()
+}
+
 func main() {
 
+	if len(os.Args) > 1 && os.Args[1] == "routes" {
+		runRoutes()
+		return
+	}
+
+	os.Exit(run())
+}
+
+// run proxies until SIGTERM or an upgrade has drained the proxy, returning the exit code once the access
+// log, the webhooks and the spans still queued have been flushed.
+func run() int {
 	args := TcpProxyArgs{}
 
 	// General cli flags
 	args.htmlEndpointBind = flag.String("status", ":8001", "Address:port used by the status endpoint")
-	args.logLevel = flag.Int("debug", 0, "Enable debugging. Default disabled")
+	args.logLevel = flag.Int("debug", 0, "Enable debug logging, kept for compatibility with --log-level debug")
+	args.logLevelName = flag.String("log-level", "info", "The minimum level logged of 'debug', 'info', 'warn' and 'error'")
+	args.logFormat = flag.String("log-format", "logfmt", "The format of the logs, 'logfmt' or 'json'")
+	args.shutdownTimeout = flag.Duration("shutdown-timeout", 30 * time.Second, "How long sessions get to end on SIGTERM before they are closed")
+	args.shutdownDelay = flag.Duration("shutdown-delay", 0, "How long /status answers 503 on SIGTERM before clients are no longer accepted, part of the shutdown timeout")
+
+	// Status endpoint security flags
+	args.statusTokensFile = flag.String("status-tokens", "", "File of '<read|admin> <token>' lines accepted as bearer tokens by the status endpoint")
+	args.statusCertFile = flag.String("status-cert", "", "Certificate used to serve the status endpoint over TLS")
+	args.statusKeyFile = flag.String("status-key", "", "Private key used to serve the status endpoint over TLS")
+	args.statusClientCAFile = flag.String("status-client-ca", "", "CA used to verify client certificates on the status endpoint, requires --status-cert")
+	args.statusReadClients = flag.String("status-read-clients", "", "Comma separated client certificate common names with read access")
+	args.statusAdminClients = flag.String("status-admin-clients", "", "Comma separated client certificate common names with admin access")
+	args.statusAnonymous = flag.Bool("status-anonymous", true, "Allow /status without credentials, for load balancer health checks")
 
 	// General backend flags
-	args.awsRegion = flag.String("region", "us-east-1", "The AWS region in which the DynamoDB instance is located")
-	args.backend = flag.String("backend", "static", "The backend to use of 'static' and 'dynamodb'")
+	args.backend = flag.String("backend", "static", "The backend to use of 'static', 'dynamodb', 'elasticache', 'rds', 'ec2', 'srv', 'consul' and 'http', or a comma separated list of them to merge")
 	args.proxyName = flag.String("proxy", "", "This flag sets the name of the proxy")
+	args.guardPercent = flag.Int("guard-percent", 50, "Hold updates removing more than this percentage of the routes, 0 only holds updates removing all of them")
+	args.guardPolls = flag.Int("guard-polls", 0, "Apply held updates once this many consecutive polls return them, 0 disables the guard")
+	args.webhooks = flag.String("webhooks", "", "Comma separated URLs notified of route and health changes, signed with TCPPROXY_WEBHOOK_SIGNING_KEY when it is set")
+	args.accessLogPath = flag.String("access-log", "", "File the access log is written to, '-' for stdout, reopened on SIGHUP for logrotate. Disabled by default")
+	args.accessLogFormat = flag.String("access-log-format", "json", "The format of the access log, 'json' or a template of HAProxy style variables like '" + accesslog.DefaultTemplate + "'")
+	args.otlpEndpoint = flag.String("otlp-endpoint", "", "OTLP/HTTP URL session and poll spans are exported to, like http://localhost:4318. Tracing is off unless this or OTEL_EXPORTER_OTLP_ENDPOINT is set")
+	args.snapshotPath = flag.String("snapshot", "", "File saving the last applied connections, used at startup when the backend is unavailable")
 
 	// Specific backend configuration flags
-	args.staticConnectionsConfigurationList = flag.String("connections", "", "Comma separated list: srcPort:destHost:destPort,srcPort2:destHost2:destPort2")
-	args.dynamodbTableName = flag.String("dynamodb", "classic-proxy", "This flag indicates the table on which the application operates, it must already exist")
-	args.elasticacheClusterID = flag.String("elasticache-cluster-id", "", "This flag indicates the id of the Elasticache Cluster for which this program should proxy")
-	args.elasticacheClusterLocalPort = flag.Int("elasticache-port", -1, "The local port from which the selected elasticache instance is proxied")
+	RegisterBackendFlags(flag.CommandLine, &args)
 
 	flag.Parse()
 
-	logLevel := *args.logLevel
+	logger, err := GetLogger(args, os.Stderr)
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		return -1
+	}
+
+	// Anything still logging through the log package or slog's default ends up in the same format
+	slog.SetDefault(logger)
+
+	// Listeners passed by systemd, or handed down by the process upgrading to this one
+	if err := proxy.InheritListeners(logger); err != nil {
+		logger.Error("Error inheriting listeners", "error", err)
+		return 1
+	}
 
 	if *args.backend == "" {
-		log.Fatal("Error: Blank backend specified.")
+		logger.Error("Blank backend specified")
 		flag.Usage()
-		os.Exit(-1)
+		return -1
 	}
 
-	backend, err := GetBackend(args)
+	backend, err := GetBackend(logger, args)
 
 	if err != nil {
-		log.Fatal(err)
+		logger.Error("Error creating the backend", "error", err)
 		flag.Usage()
-		os.Exit(-1)
+		return -1
 	}
 
-	tcpBackend := func(proxyInstance *proxy.Proxy) {
-		proxy.RunTcpProxy(logLevel, proxyInstance.CreateChannel, proxyInstance.KillChannel, func() {
-			if logLevel > 0 {
-				log.Println("Initialised Proxy")
-			}
-			mux := web.InitialiseEndpoints(logLevel, *args.proxyName, proxyInstance)
-			http.ListenAndServe(*args.htmlEndpointBind, mux)
-		})
+	// Also closed by the shutdown, this covers starting failing and the process upgrading to another
+	defer backends.Close(backend)
+
+	auth, err := GetAuth(args)
+
+	if err != nil {
+		logger.Error("Error configuring the status endpoint", "error", err)
+		return 1
+	}
+
+	tracerProvider, err := GetTracerProvider(args)
+
+	if err != nil {
+		logger.Error("Error configuring tracing", "error", err)
+		return 1
+	}
+
+	if tracerProvider != nil {
+		otel.SetTracerProvider(tracerProvider)
+
+		// Flushes the spans still batched when the proxy stops
+		defer tracerProvider.Shutdown(context.Background())
 	}
 
-	err = proxy.RunProxy(backend, logLevel, tcpBackend)
+	proxyServer, err := proxy.New(
+		proxy.WithBackend(backend),
+		proxy.WithLogger(logger),
+		proxy.WithSnapshot(*args.snapshotPath),
+		proxy.WithGuard(proxy.DeletionGuard{MaxRemovedPercent: *args.guardPercent, Polls: *args.guardPolls}),
+		proxy.WithShutdownDelay(*args.shutdownDelay),
+	)
 
 	if err != nil {
-		log.Fatal("Error fetching connections", nil)
+		logger.Error("Error creating the proxy", "error", err)
+		return 1
+	}
+
+	mux := web.InitialiseEndpoints(logger, *args.proxyName, proxyServer.Proxy(), auth)
+	statusServer, err := CreateStatusServer(args, mux)
+
+	if err != nil {
+		logger.Error("Error configuring the status endpoint", "error", err)
+		return 1
+	}
+
+	// Taken over from systemd or the process upgrading to this one, like the listeners of the routes
+	statusListener, err := proxy.ListenTCP(*args.htmlEndpointBind, "status")
+
+	if err != nil {
+		logger.Error("Error listening for the status endpoint", "error", err)
+		return 1
+	}
+
+	ShutdownOnSignal(logger, proxyServer, statusServer, *args.shutdownTimeout)
+
+	upgrade := CreateUpgrade(logger, args, proxyServer, statusServer, statusListener, *args.shutdownTimeout)
+	UpgradeOnSignal(logger, upgrade)
+	mux.HandleFunc("/upgrade", auth.Require(web.RoleAdmin, web.Upgrade(logger, upgrade)))
+
+	if *args.webhooks != "" {
+		notifier := notify.CreateWebhookNotifier(logger, *args.proxyName, strings.Split(*args.webhooks, ","), os.Getenv("TCPPROXY_WEBHOOK_SIGNING_KEY"))
+		defer notifier.Close()
+
+		proxyServer.Subscribe(notifier.Notify)
+	}
+
+	var accessLog *accesslog.AccessLog
+
+	if *args.accessLogPath != "" {
+		accessLog, err = accesslog.CreateAccessLog(*args.accessLogPath, *args.accessLogFormat)
+
+		if err != nil {
+			logger.Error("Error opening the access log", "path", *args.accessLogPath, "error", err)
+			return 1
+		}
+
+		defer accessLog.Close()
+
+		proxyServer.Subscribe(accessLog.Log)
+	}
+
+	ReloadOnSignal(logger, proxyServer, accessLog)
+
+	// Fails when the backend is unavailable without a snapshot, or a route can't listen
+	if err := proxyServer.Start(context.Background()); err != nil {
+		logger.Error("Error starting the proxy", "error", err)
+		return 1
+	}
+
+	logger.Info("Initialised Proxy")
+
+	// Start has waited for every route to listen, so the process upgrading to this one only drains once all
+	// of them are taken over
+	if err := proxy.NotifyReady(); err != nil {
+		logger.Error("Error reporting the upgrade is ready", "error", err)
+	}
+
+	// Returns once SIGTERM or an upgrade has drained the proxy
+	if err := ServeStatus(args, statusServer, statusListener); err != nil {
+		logger.Error("Error serving the status endpoint", "error", err)
+		return 1
 	}
 
+	return 0
 }
@@ -0,0 +1,266 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+	"github.com/brandnetworks/tcpproxy/proxy"
+)
+
+const (
+	requestTimeout = 10 * time.Second
+	maxAttempts    = 5
+
+	// Events waiting for a slow webhook before the next ones are dropped
+	queueLength = 256
+
+	// How long the health of an upstream has to settle before it is notified, so a flapping one doesn't
+	// send a notification per dial
+	healthDelay = 10 * time.Second
+)
+
+// The events worth a notification, the others are too frequent
+var notified = map[proxy.EventType]bool{
+	proxy.RouteCreated:  true,
+	proxy.RouteKilled:   true,
+	proxy.RouteUpdated:  true,
+	proxy.HealthChanged: true,
+}
+
+// The health of an upstream as last notified, and the change waiting for healthDelay to pass
+type upstreamHealth struct {
+	healthy bool
+	pending *proxy.Event
+	timer   *time.Timer
+}
+
+// The JSON body posted to the webhooks
+type payload struct {
+	Proxy string      `json:"proxy,omitempty"`
+	Event proxy.Event `json:"event"`
+}
+
+// CreateWebhookNotifier posts route and health changes to each url. When signingKey isn't empty every
+// request carries a "sha256=<hex>" HMAC-SHA256 of its body in the X-Tcpproxy-Signature header.
+func CreateWebhookNotifier(logger *slog.Logger, proxyName string, urls []string, signingKey string) *WebhookNotifier {
+	notifier := &WebhookNotifier{
+		logger: logger,
+		proxyName: proxyName,
+		signingKey: []byte(signingKey),
+		client: &http.Client{Timeout: requestTimeout},
+		retryDelay: time.Second,
+		healthDelay: healthDelay,
+		health: make(map[string]*upstreamHealth),
+		quit: make(chan struct{}),
+	}
+
+	// Each webhook has its own queue, so one that is down doesn't hold up the others
+	for _, url := range urls {
+		queue := make(chan []byte, queueLength)
+		notifier.queues = append(notifier.queues, queue)
+
+		notifier.wg.Add(1)
+		go notifier.deliver(url, queue)
+	}
+
+	return notifier
+}
+
+type WebhookNotifier struct {
+	logger *slog.Logger
+	proxyName string
+	signingKey []byte
+	client *http.Client
+	retryDelay time.Duration
+	healthDelay time.Duration
+
+	// By route and target
+	healthLock sync.Mutex
+	health map[string]*upstreamHealth
+
+	queues []chan []byte
+	quit chan struct{}
+	closeOnce sync.Once
+	wg sync.WaitGroup
+}
+
+// Notify queues the event for delivery, it is meant to be subscribed to the proxy's events. Health changes
+// wait for the health of the upstream to settle, and are dropped when it ends up as it was last notified.
+func (n *WebhookNotifier) Notify(event proxy.Event) {
+	if !notified[event.Type] {
+		return
+	}
+
+	if event.Type == proxy.HealthChanged && event.Healthy != nil {
+		n.debounceHealth(event)
+		return
+	}
+
+	n.enqueue(event)
+}
+
+func (n *WebhookNotifier) debounceHealth(event proxy.Event) {
+	key := event.Route + " " + event.Target
+
+	n.healthLock.Lock()
+	defer n.healthLock.Unlock()
+
+	// Upstreams start out healthy
+	state, ok := n.health[key]
+
+	if !ok {
+		state = &upstreamHealth{healthy: true}
+		n.health[key] = state
+	}
+
+	state.pending = &event
+
+	// The delay runs from the first change, so an upstream flapping for longer is still notified once per delay
+	if state.timer == nil {
+		state.timer = time.AfterFunc(n.healthDelay, func() {
+			n.settleHealth(key)
+		})
+	}
+}
+
+func (n *WebhookNotifier) settleHealth(key string) {
+	n.healthLock.Lock()
+
+	state := n.health[key]
+	event := *state.pending
+	changed := *event.Healthy != state.healthy
+
+	state.healthy = *event.Healthy
+	state.pending = nil
+	state.timer = nil
+
+	if state.healthy {
+		delete(n.health, key)
+	}
+
+	n.healthLock.Unlock()
+
+	if changed {
+		n.enqueue(event)
+	}
+}
+
+func (n *WebhookNotifier) enqueue(event proxy.Event) {
+	body, err := json.Marshal(payload{Proxy: n.proxyName, Event: event})
+
+	if err != nil {
+		n.logger.Error("Error encoding webhook payload", "error", err)
+		return
+	}
+
+	for _, queue := range n.queues {
+		select {
+		case queue <- body:
+		default:
+			n.logger.Warn("Dropping webhook, too many are waiting for delivery", "event", event.Type)
+		}
+	}
+}
+
+// Close stops delivering, dropping the notifications still queued or waiting for the health to settle.
+func (n *WebhookNotifier) Close() {
+	n.closeOnce.Do(func() {
+		close(n.quit)
+	})
+
+	n.healthLock.Lock()
+
+	for key, state := range n.health {
+		if state.timer != nil && state.timer.Stop() {
+			delete(n.health, key)
+		}
+	}
+
+	n.healthLock.Unlock()
+
+	n.wg.Wait()
+}
+
+func (n *WebhookNotifier) deliver(url string, queue chan []byte) {
+	defer n.wg.Done()
+
+	for {
+		select {
+		case <-n.quit:
+			return
+		case body := <-queue:
+			n.post(url, body)
+		}
+	}
+}
+
+// post retries failed deliveries, doubling the delay between attempts.
+func (n *WebhookNotifier) post(url string, body []byte) {
+	delay := n.retryDelay
+
+	for attempt := 1; ; attempt++ {
+		retry, err := n.send(url, body)
+
+		if err == nil {
+			n.logger.Debug("Delivered webhook", "url", url)
+
+			return
+		}
+
+		if !retry || attempt == maxAttempts {
+			n.logger.Error("Giving up on webhook", "url", url, "attempts", attempt, "error", err)
+			return
+		}
+
+		n.logger.Warn("Error delivering webhook", "url", url, "retry_in", delay, "error", err)
+
+		select {
+		case <-n.quit:
+			return
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+	}
+}
+
+// send reports whether a failed request is worth retrying.
+func (n *WebhookNotifier) send(url string, body []byte) (bool, error) {
+	request, err := http.NewRequest("POST", url, bytes.NewReader(body))
+
+	if err != nil {
+		return false, err
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+
+	if len(n.signingKey) > 0 {
+		mac := hmac.New(sha256.New, n.signingKey)
+		mac.Write(body)
+		request.Header.Set("X-Tcpproxy-Signature", "sha256=" + hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	response, err := n.client.Do(request)
+
+	if err != nil {
+		return true, err
+	}
+
+	response.Body.Close()
+
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return false, nil
+	}
+
+	// Client errors won't go away by sending the same request again, apart from rate limiting
+	retry := response.StatusCode >= 500 || response.StatusCode == http.StatusTooManyRequests
+
+	return retry, fmt.Errorf("Webhook responded %s", response.Status)
+}
@@ -0,0 +1,186 @@
+package notify
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+	"github.com/brandnetworks/tcpproxy/proxy"
+	"github.com/stretchr/testify/assert"
+)
+
+// receiver is a webhook failing the first requests it gets
+type receiver struct {
+	sync.Mutex
+	failures  int
+	status    int
+	attempts  int
+	bodies    chan []byte
+	signature string
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+	body, _ := ioutil.ReadAll(request.Body)
+
+	r.Lock()
+	r.attempts++
+	failing := r.attempts <= r.failures
+	r.signature = request.Header.Get("X-Tcpproxy-Signature")
+	r.Unlock()
+
+	if failing {
+		w.WriteHeader(r.status)
+		return
+	}
+
+	r.bodies <- body
+}
+
+func (r *receiver) attempted() int {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.attempts
+}
+
+func TestDeliverWithRetries(t *testing.T) {
+	stub := &receiver{failures: 2, status: http.StatusServiceUnavailable, bodies: make(chan []byte, 1)}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	notifier := CreateWebhookNotifier(slog.New(slog.DiscardHandler), "test", []string{server.URL}, "signing-key")
+	notifier.retryDelay = time.Millisecond
+	defer notifier.Close()
+
+	// Sessions are too frequent to notify
+	notifier.Notify(proxy.Event{Type: proxy.SessionOpened})
+	notifier.Notify(proxy.Event{Type: proxy.RouteKilled, Route: "8002:example.com:5432"})
+
+	var body []byte
+
+	select {
+	case body = <-stub.bodies:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Webhook not delivered")
+	}
+
+	assert.Equal(t, 3, stub.attempted())
+
+	var delivered payload
+	assert.Nil(t, json.Unmarshal(body, &delivered))
+	assert.Equal(t, "test", delivered.Proxy)
+	assert.Equal(t, proxy.RouteKilled, delivered.Event.Type)
+	assert.Equal(t, "8002:example.com:5432", delivered.Event.Route)
+
+	mac := hmac.New(sha256.New, []byte("signing-key"))
+	mac.Write(body)
+
+	stub.Lock()
+	assert.Equal(t, "sha256=" + hex.EncodeToString(mac.Sum(nil)), stub.signature)
+	stub.Unlock()
+}
+
+func TestNoRetryOnClientError(t *testing.T) {
+	stub := &receiver{failures: 1, status: http.StatusBadRequest, bodies: make(chan []byte, 1)}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	notifier := CreateWebhookNotifier(slog.New(slog.DiscardHandler), "test", []string{server.URL}, "")
+	notifier.retryDelay = time.Millisecond
+	defer notifier.Close()
+
+	notifier.Notify(proxy.Event{Type: proxy.RouteCreated})
+	notifier.Notify(proxy.Event{Type: proxy.RouteCreated})
+
+	// The first is dropped, the second one goes through
+	select {
+	case <-stub.bodies:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Webhook not delivered")
+	}
+
+	assert.Equal(t, 2, stub.attempted())
+
+	stub.Lock()
+	assert.Empty(t, stub.signature)
+	stub.Unlock()
+}
+
+func TestDebounceHealth(t *testing.T) {
+	stub := &receiver{bodies: make(chan []byte, 4)}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	notifier := CreateWebhookNotifier(slog.New(slog.DiscardHandler), "test", []string{server.URL}, "")
+	notifier.healthDelay = 50 * time.Millisecond
+	defer notifier.Close()
+
+	health := func(healthy bool) proxy.Event {
+		return proxy.Event{Type: proxy.HealthChanged, Route: "8002:example.com:5432", Target: "10.0.0.1:5432", Healthy: &healthy}
+	}
+
+	// Flapping back to healthy within the delay notifies nothing
+	notifier.Notify(health(false))
+	notifier.Notify(health(true))
+	notifier.Notify(health(false))
+	notifier.Notify(health(true))
+
+	select {
+	case <-stub.bodies:
+		t.Fatal("Flapping upstream notified")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Staying unhealthy is notified once
+	notifier.Notify(health(false))
+	notifier.Notify(health(true))
+	notifier.Notify(health(false))
+
+	var body []byte
+
+	select {
+	case body = <-stub.bodies:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Webhook not delivered")
+	}
+
+	var delivered payload
+	assert.Nil(t, json.Unmarshal(body, &delivered))
+	assert.Equal(t, proxy.HealthChanged, delivered.Event.Type)
+	assert.False(t, *delivered.Event.Healthy)
+
+	select {
+	case <-stub.bodies:
+		t.Fatal("Health notified twice")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	assert.Equal(t, 1, stub.attempted())
+}
+
+func TestNotifyRouteUpdated(t *testing.T) {
+	stub := &receiver{bodies: make(chan []byte, 1)}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	notifier := CreateWebhookNotifier(slog.New(slog.DiscardHandler), "test", []string{server.URL}, "")
+	defer notifier.Close()
+
+	notifier.Notify(proxy.Event{Type: proxy.RouteUpdated, Route: "8002:example.com:5432", Reason: proxy.ReloadApplied})
+
+	select {
+	case body := <-stub.bodies:
+		var delivered payload
+		assert.Nil(t, json.Unmarshal(body, &delivered))
+		assert.Equal(t, proxy.RouteUpdated, delivered.Event.Type)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Webhook not delivered")
+	}
+}
@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+	"github.com/brandnetworks/tcpproxy/backends"
+)
+
+type EventType string
+
+const (
+	RouteCreated   EventType = "route_created"
+	RouteKilled    EventType = "route_killed"
+	RouteUpdated   EventType = "route_updated"
+	SessionOpened  EventType = "session_opened"
+	SessionClosed  EventType = "session_closed"
+	DialFailed     EventType = "dial_failed"
+	PollFailed     EventType = "poll_failed"
+	HealthChanged  EventType = "health_changed"
+	ConfigReloaded EventType = "config_reloaded"
+	ListenFailed   EventType = "listen_failed"
+)
+
+// Event is something that happened to a route, one of its sessions, or the backend. Only the fields
+// relevant to its type are set, Sent and Received count the bytes sent to and received from the client.
+// A session failing to reach any upstream is closed with the dial_failed reason without being opened.
+// A config_reloaded event carries the outcome of the reload as its reason, see Proxy.Reload. A route_updated
+// event is a route changed in place, carrying its previous and new configurations, with a rejected reason and
+// the error when the new one was invalid and the previous one kept.
+type Event struct {
+	Type     EventType     `json:"type"`
+	Time     time.Time     `json:"time"`
+	Route    string        `json:"route,omitempty"`
+	Local    string        `json:"local,omitempty"`
+	Session  string        `json:"session,omitempty"`
+	Client   string        `json:"client,omitempty"`
+	Target   string        `json:"target,omitempty"`
+	Healthy  *bool         `json:"healthy,omitempty"`
+	Sent     int64         `json:"sent,omitempty"`
+	Received int64         `json:"received,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+	Reason   string        `json:"reason,omitempty"`
+	Error    string        `json:"error,omitempty"`
+
+	Previous *backends.ConnectionConfig `json:"previous,omitempty"`
+	Config   *backends.ConnectionConfig `json:"config,omitempty"`
+}
+
+// EventBus hands events to its subscribers. A nil bus drops them, so code paths without one don't need to check.
+type EventBus struct {
+	lock     sync.RWMutex
+	handlers map[int]func(Event)
+	next     int
+}
+
+func CreateEventBus() *EventBus {
+	return &EventBus{handlers: make(map[int]func(Event))}
+}
+
+// Subscribe calls handler for every event until the returned function is called. Handlers are called
+// from the goroutine publishing the event, often one proxying a session or polling, so they must not block.
+// Anything slow, like delivering webhooks or streaming to a client, is queued for a goroutine of its own.
+// Handlers may subscribe and unsubscribe, and an event published concurrently may still reach a handler
+// that was just unsubscribed.
+func (b *EventBus) Subscribe(handler func(Event)) func() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	id := b.next
+	b.next++
+	b.handlers[id] = handler
+
+	return func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+
+		delete(b.handlers, id)
+	}
+}
+
+func (b *EventBus) Publish(event Event) {
+	if b == nil {
+		return
+	}
+
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	// Called without holding the lock, so a handler subscribing or unsubscribing doesn't deadlock
+	b.lock.RLock()
+	handlers := make([]func(Event), 0, len(b.handlers))
+
+	for _, handler := range b.handlers {
+		handlers = append(handlers, handler)
+	}
+
+	b.lock.RUnlock()
+
+	for _, handler := range handlers {
+		handler(event)
+	}
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	return err.Error()
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"testing"
+	"github.com/brandnetworks/tcpproxy/backends"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscribe(t *testing.T) {
+	bus := CreateEventBus()
+	received := make([]Event, 0)
+
+	unsubscribe := bus.Subscribe(func(event Event) {
+		received = append(received, event)
+	})
+
+	bus.Publish(Event{Type: PollFailed, Error: "AccessDeniedException"})
+	unsubscribe()
+	bus.Publish(Event{Type: PollFailed})
+
+	assert.Len(t, received, 1)
+	assert.Equal(t, PollFailed, received[0].Type)
+	assert.False(t, received[0].Time.IsZero())
+
+	// A nil bus drops events
+	var none *EventBus
+	none.Publish(Event{Type: PollFailed})
+}
+
+func TestUnsubscribeFromHandler(t *testing.T) {
+	bus := CreateEventBus()
+	received := 0
+
+	var unsubscribe func()
+	unsubscribe = bus.Subscribe(func(event Event) {
+		received++
+		unsubscribe()
+
+		bus.Subscribe(func(event Event) {})
+	})
+
+	bus.Publish(Event{Type: PollFailed})
+	bus.Publish(Event{Type: PollFailed})
+
+	assert.Equal(t, 1, received)
+}
+
+func TestRouteEvents(t *testing.T) {
+	backend := &flakyBackend{connections: "8001:example.com:5431,8002:example.com:5432"}
+	proxy := CreateProxy(backend)
+	drain(proxy)
+
+	received := make([]Event, 0)
+	proxy.Subscribe(func(event Event) {
+		received = append(received, event)
+	})
+
+	assert.Nil(t, proxy.UpdateConnections())
+
+	backend.connections = "8001:example.com:5431"
+	assert.Nil(t, proxy.UpdateConnections())
+
+	backend.err = fmt.Errorf("AccessDeniedException")
+	assert.NotNil(t, proxy.UpdateConnections())
+
+	types := make([]EventType, len(received))
+	for i := range received {
+		types[i] = received[i].Type
+	}
+
+	assert.ElementsMatch(t, []EventType{RouteCreated, RouteCreated}, types[:2])
+	assert.Equal(t, []EventType{RouteKilled, PollFailed}, types[2:])
+	assert.Equal(t, "8002:example.com:5432", received[2].Route)
+	assert.Equal(t, "AccessDeniedException", received[3].Error)
+}
+
+func TestRouteUpdatedEvents(t *testing.T) {
+	proxy := CreateProxy(&flakyBackend{})
+	drain(proxy)
+
+	received := make([]Event, 0)
+	proxy.Subscribe(func(event Event) {
+		if event.Type == RouteUpdated {
+			received = append(received, event)
+		}
+	})
+
+	config, _ := backends.ParseConnection("8001:example.com:5431")
+	assert.Nil(t, proxy.applyConnections([]backends.ConnectionConfig{*config}))
+
+	// The url stays the same, so the route is updated in place
+	updated := *config
+	updated.Targets = []backends.Target{{Address: "other.example.com:5431", Weight: 1}}
+	assert.Nil(t, proxy.applyConnections([]backends.ConnectionConfig{updated}))
+
+	invalid := updated
+	invalid.AllowedCIDRs = []string{"10.0.0.0/33"}
+	assert.Nil(t, proxy.applyConnections([]backends.ConnectionConfig{invalid}))
+
+	assert.Len(t, received, 2)
+
+	assert.Equal(t, "8001:example.com:5431", received[0].Route)
+	assert.Equal(t, ReloadApplied, received[0].Reason)
+	assert.Equal(t, *config, *received[0].Previous)
+	assert.Equal(t, updated, *received[0].Config)
+	assert.Empty(t, received[0].Error)
+
+	// The invalid configuration is reported, while the route keeps the previous one
+	assert.Equal(t, ReloadRejected, received[1].Reason)
+	assert.Equal(t, updated, *received[1].Previous)
+	assert.Equal(t, invalid, *received[1].Config)
+	assert.NotEmpty(t, received[1].Error)
+	assert.Equal(t, updated, proxy.Routes()[0].Config)
+}
+
+func TestHealthEvents(t *testing.T) {
+	// Nothing listens on a port freed straight away
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	address := closed.Addr().String()
+	closed.Close()
+
+	config, _ := backends.ParseConnection("18010:127.0.0.1:1")
+	config.Targets = []backends.Target{{Address: address}}
+
+	r, err := newRoute(*config)
+	assert.Nil(t, err)
+
+	r.events = CreateEventBus()
+	received := make([]Event, 0)
+	r.events.Subscribe(func(event Event) {
+		received = append(received, event)
+	})
+
+	_, err = r.dial(context.Background(), slog.New(slog.DiscardHandler))
+	assert.NotNil(t, err)
+	_, err = r.dial(context.Background(), slog.New(slog.DiscardHandler))
+	assert.NotNil(t, err)
+
+	// The second failure doesn't change the health again
+	assert.Len(t, received, 3)
+	assert.Equal(t, DialFailed, received[0].Type)
+	assert.Equal(t, HealthChanged, received[1].Type)
+	assert.False(t, *received[1].Healthy)
+	assert.Equal(t, DialFailed, received[2].Type)
+
+	listener, err := net.Listen("tcp", address)
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	conn, err := r.dial(context.Background(), slog.New(slog.DiscardHandler))
+	assert.Nil(t, err)
+	conn.Close()
+
+	assert.Len(t, received, 4)
+	assert.Equal(t, HealthChanged, received[3].Type)
+	assert.True(t, *received[3].Healthy)
+	assert.Equal(t, address, received[3].Target)
+}
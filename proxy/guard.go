@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"reflect"
+	"sort"
+	"time"
+	"github.com/brandnetworks/tcpproxy/backends"
+)
+
+// DeletionGuard holds back updates removing a large share of the routes, which are more likely a bad answer of
+// the backend (an empty query, a wrong proxy name, missing permissions) than a real change.
+type DeletionGuard struct {
+	// Updates removing more than this percentage of the live routes are held, 0 only holds updates removing all of them
+	MaxRemovedPercent int
+
+	// How many consecutive polls must return the same routes before a held update is applied, 0 disables the guard
+	Polls int
+
+	// How long after a counted poll the next one counts, so reloads and pushed changes in between don't add up to
+	// the polls. Half the poll interval when 0, which leaves room for the ticker to be late
+	Interval time.Duration
+}
+
+// HeldChange describes an update the guard is holding back.
+type HeldChange struct {
+	Since   time.Time `json:"since"`
+	Live    int       `json:"live"`
+	Removed int       `json:"removed"`
+	Polls   int       `json:"polls"`
+
+	urls    []string
+	counted time.Time
+}
+
+// suspicious reports how many live routes the update removes, and whether that's more than the guard allows.
+func (g DeletionGuard) suspicious(connections []backends.ConnectionConfig, live map[string]Connection) (int, bool) {
+	if g.Polls <= 0 || len(live) == 0 {
+		return 0, false
+	}
+
+	wanted := make(map[string]bool)
+
+	for _, connection := range connections {
+		wanted[connection.Url] = true
+	}
+
+	removed := 0
+
+	for url := range live {
+		if !wanted[url] {
+			removed++
+		}
+	}
+
+	if removed == len(live) {
+		return removed, true
+	}
+
+	return removed, g.MaxRemovedPercent > 0 && removed * 100 > g.MaxRemovedPercent * len(live)
+}
+
+func connectionUrls(connections []backends.ConnectionConfig) []string {
+	urls := make([]string, len(connections))
+
+	for i := range connections {
+		urls[i] = connections[i].Url
+	}
+
+	sort.Strings(urls)
+
+	return urls
+}
+
+func (g DeletionGuard) interval() time.Duration {
+	if g.Interval > 0 {
+		return g.Interval
+	}
+
+	return pollInterval / 2
+}
+
+// hold records another poll returning the suspicious update, and reports whether it has been confirmed.
+// A poll returning different routes starts the count again, while one coming too soon after the last
+// counted poll leaves it as it is.
+func (g DeletionGuard) hold(held *HeldChange, connections []backends.ConnectionConfig, live int, removed int) (*HeldChange, bool) {
+	urls := connectionUrls(connections)
+	now := time.Now()
+
+	if held == nil || !reflect.DeepEqual(held.urls, urls) {
+		held = &HeldChange{Since: now.UTC(), urls: urls}
+	}
+
+	held.Live = live
+	held.Removed = removed
+
+	if held.Polls == 0 || now.Sub(held.counted) >= g.interval() {
+		held.Polls++
+		held.counted = now
+	}
+
+	return held, held.Polls >= g.Polls
+}
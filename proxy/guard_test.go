@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+func drain(proxy *Proxy) {
+	go func() {
+		for {
+			select {
+			case <-proxy.CreateChannel:
+			case <-proxy.KillChannel:
+			}
+		}
+	}()
+}
+
+func TestGuardHoldsMassDeletion(t *testing.T) {
+	backend := &flakyBackend{connections: "8001:example.com:5431,8002:example.com:5432,8003:example.com:5433,8004:example.com:5434"}
+	proxy := CreateProxy(backend)
+	proxy.Guard = DeletionGuard{MaxRemovedPercent: 50, Polls: 3, Interval: time.Nanosecond}
+	drain(proxy)
+
+	assert.Nil(t, proxy.UpdateConnections())
+	assert.Len(t, proxy.Routes(), 4)
+
+	// Removing half of the routes is allowed
+	backend.connections = "8001:example.com:5431,8002:example.com:5432"
+	assert.Nil(t, proxy.UpdateConnections())
+	assert.Len(t, proxy.Routes(), 2)
+	assert.Nil(t, proxy.Held())
+
+	// Removing all of them is held until three polls in a row agree
+	backend.connections = ""
+
+	assert.Nil(t, proxy.UpdateConnections())
+	assert.Len(t, proxy.Routes(), 2)
+
+	held := proxy.Held()
+	assert.NotNil(t, held)
+	assert.Equal(t, 2, held.Removed)
+	assert.Equal(t, 1, held.Polls)
+
+	assert.Nil(t, proxy.UpdateConnections())
+	assert.Len(t, proxy.Routes(), 2)
+	assert.Equal(t, 2, proxy.Held().Polls)
+
+	assert.Nil(t, proxy.UpdateConnections())
+	assert.Empty(t, proxy.Routes())
+	assert.Nil(t, proxy.Held())
+}
+
+func TestGuardRestartsOnDifferentUpdate(t *testing.T) {
+	backend := &flakyBackend{connections: "8001:example.com:5431,8002:example.com:5432,8003:example.com:5433"}
+	proxy := CreateProxy(backend)
+	proxy.Guard = DeletionGuard{MaxRemovedPercent: 50, Polls: 2, Interval: time.Nanosecond}
+	drain(proxy)
+
+	assert.Nil(t, proxy.UpdateConnections())
+
+	backend.connections = "8001:example.com:5431"
+	assert.Nil(t, proxy.UpdateConnections())
+	assert.Equal(t, 1, proxy.Held().Polls)
+
+	// A different answer isn't a confirmation
+	backend.connections = "8002:example.com:5432"
+	assert.Nil(t, proxy.UpdateConnections())
+	assert.Equal(t, 1, proxy.Held().Polls)
+	assert.Len(t, proxy.Routes(), 3)
+
+	// Going back to a harmless answer drops the held update
+	backend.connections = "8001:example.com:5431,8002:example.com:5432,8003:example.com:5433"
+	assert.Nil(t, proxy.UpdateConnections())
+	assert.Nil(t, proxy.Held())
+}
+
+func TestGuardDisabled(t *testing.T) {
+	backend := &flakyBackend{connections: "8001:example.com:5431"}
+	proxy := CreateProxy(backend)
+	drain(proxy)
+
+	assert.Nil(t, proxy.UpdateConnections())
+
+	backend.connections = ""
+	assert.Nil(t, proxy.UpdateConnections())
+	assert.Empty(t, proxy.Routes())
+}
+
+func TestGuardIgnoresUpdatesBetweenPolls(t *testing.T) {
+	backend := &flakyBackend{connections: "8001:example.com:5431,8002:example.com:5432"}
+	proxy := CreateProxy(backend)
+	proxy.Guard = DeletionGuard{Polls: 2, Interval: 100 * time.Millisecond}
+	drain(proxy)
+
+	assert.Nil(t, proxy.UpdateConnections())
+
+	backend.connections = ""
+	assert.Nil(t, proxy.UpdateConnections())
+	assert.Equal(t, 1, proxy.Held().Polls)
+
+	// A reload right after the poll, like a SIGHUP, doesn't confirm it
+	outcome, err := proxy.Reload()
+	assert.Equal(t, errHeld, err)
+	assert.Equal(t, ReloadRejected, outcome)
+	assert.Equal(t, 1, proxy.Held().Polls)
+	assert.Len(t, proxy.Routes(), 2)
+
+	// The next poll does
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, proxy.UpdateConnections())
+	assert.Empty(t, proxy.Routes())
+	assert.Nil(t, proxy.Held())
+}
@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Maps the inherited file descriptors to the addresses they listen on, as fd=address pairs separated by commas
+const listenersEnv = "TCPPROXY_LISTENERS"
+
+// listenerRegistry holds the listening sockets inherited from the process that started this one, until
+// the routes listening on the same addresses take them over.
+type listenerRegistry struct {
+	sync.Mutex
+	listeners []inheritedListener
+}
+
+type inheritedListener struct {
+	// Set by systemd from FileDescriptorName, only matched against the names ListenTCP is given explicitly
+	name     string
+	address  string
+	listener net.Listener
+}
+
+var inherited = &listenerRegistry{}
+
+func (l *listenerRegistry) add(name string, address string, listener net.Listener) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.listeners = append(l.listeners, inheritedListener{name: name, address: address, listener: listener})
+}
+
+// take hands over the inherited listener named one of names, or else listening on address. Each
+// listener is only handed over once.
+func (l *listenerRegistry) take(address string, names ...string) (net.Listener, bool) {
+	l.Lock()
+	defer l.Unlock()
+
+	i := l.find(address, names)
+
+	if i < 0 {
+		return nil, false
+	}
+
+	listener := l.listeners[i].listener
+	l.listeners = append(l.listeners[:i], l.listeners[i + 1:]...)
+
+	return listener, true
+}
+
+func (l *listenerRegistry) find(address string, names []string) int {
+	for _, name := range names {
+		for i := range l.listeners {
+			if name != "" && l.listeners[i].name == name {
+				return i
+			}
+		}
+	}
+
+	for i := range l.listeners {
+		if l.listeners[i].address == address || sameAddress(address, l.listeners[i].listener.Addr()) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// closeUnused closes the listeners no route took over, so their clients aren't left queueing.
+func (l *listenerRegistry) closeUnused(logger *slog.Logger) {
+	l.Lock()
+	defer l.Unlock()
+
+	for _, unused := range l.listeners {
+		logger.Warn("Closing an inherited listener no route uses", "name", unused.name, "local", unused.address)
+		unused.listener.Close()
+	}
+
+	l.listeners = nil
+}
+
+// sameAddress reports whether listening on address would listen where actual does, so
+// ":5432" is the same as "[::]:5432" or "0.0.0.0:5432".
+func sameAddress(address string, actual net.Addr) bool {
+	tcpAddr, ok := actual.(*net.TCPAddr)
+
+	if !ok {
+		return false
+	}
+
+	host, port, err := net.SplitHostPort(address)
+
+	if err != nil {
+		return false
+	}
+
+	portNumber, err := net.LookupPort("tcp", port)
+
+	if err != nil || portNumber != tcpAddr.Port {
+		return false
+	}
+
+	if host == "" {
+		return tcpAddr.IP.IsUnspecified()
+	}
+
+	ip := net.ParseIP(host)
+
+	if ip == nil {
+		return false
+	}
+
+	// Either wildcard accepts on every address
+	if ip.IsUnspecified() {
+		return tcpAddr.IP.IsUnspecified()
+	}
+
+	return ip.Equal(tcpAddr.IP)
+}
+
+// The first file descriptor passed by systemd socket activation, see sd_listen_fds(3)
+var listenFdsStart = 3
+
+// InheritListeners adopts the listening sockets passed by systemd socket activation, and those passed
+// down by the process upgrading to this one, see StartUpgrade.
+func InheritListeners(logger *slog.Logger) error {
+	if err := inheritSystemd(logger); err != nil {
+		return err
+	}
+
+	mapping := os.Getenv(listenersEnv)
+	os.Unsetenv(listenersEnv)
+
+	if mapping == "" {
+		return nil
+	}
+
+	for _, pair := range strings.Split(mapping, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+
+		if len(parts) != 2 {
+			return fmt.Errorf("An inherited listener must be fd=address '%s'", pair)
+		}
+
+		fd, err := strconv.Atoi(parts[0])
+
+		if err != nil || fd < 3 {
+			return fmt.Errorf("Invalid inherited file descriptor '%s'", parts[0])
+		}
+
+		if err := adoptListener(parts[1], fd); err != nil {
+			return err
+		}
+
+		logger.Info("Inherited listener", "local", parts[1], "fd", fd)
+	}
+
+	return nil
+}
+
+// inheritSystemd adopts the sockets of LISTEN_FDS, named by LISTEN_FDNAMES. The routes take them over by
+// those names or by the addresses they listen on.
+func inheritSystemd(logger *slog.Logger) error {
+	pid := os.Getenv("LISTEN_PID")
+	fds := os.Getenv("LISTEN_FDS")
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// Not passed on to the processes this one starts
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	// Meant for another process, when systemd started a wrapper
+	if fds == "" || (pid != "" && pid != strconv.Itoa(os.Getpid())) {
+		return nil
+	}
+
+	count, err := strconv.Atoi(fds)
+
+	if err != nil || count < 0 {
+		return fmt.Errorf("Invalid LISTEN_FDS '%s'", fds)
+	}
+
+	for i := 0; i < count; i++ {
+		fd := listenFdsStart + i
+		name := ""
+
+		if i < len(names) {
+			name = names[i]
+		}
+
+		file := os.NewFile(uintptr(fd), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+
+		// Datagram sockets and the like are of no use to a TCP proxy
+		if err != nil {
+			logger.Warn("Ignoring a socket passed by systemd", "name", name, "fd", fd, "error", err)
+			continue
+		}
+
+		inherited.add(name, listener.Addr().String(), listener)
+
+		logger.Info("Inherited listener from systemd", "name", name, "local", listener.Addr().String(), "fd", fd)
+	}
+
+	return nil
+}
+
+func adoptListener(address string, fd int) error {
+	file := os.NewFile(uintptr(fd), address)
+
+	// FileListener works on a copy, so the original is closed either way
+	listener, err := net.FileListener(file)
+	file.Close()
+
+	if err != nil {
+		return fmt.Errorf("Error adopting inherited listener for %s: %v", address, err)
+	}
+
+	inherited.add("", address, listener)
+
+	return nil
+}
+
+// ListenTCP listens on address, taking over the inherited listener named one of names or listening on address
+// when there is one.
+func ListenTCP(address string, names ...string) (net.Listener, error) {
+	if listener, ok := inherited.take(address, names...); ok {
+		return listener, nil
+	}
+
+	return net.Listen("tcp", address)
+}
@@ -1,32 +1,99 @@
 package proxy
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
 	"time"
 	"github.com/brandnetworks/tcpproxy/backends"
-	"log"
+	"log/slog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// How often pollable backends are polled
+const pollInterval = time.Minute
+
+// How often WaitListening checks whether the routes are listening yet
+var listenCheckInterval = 10 * time.Millisecond
+
 type Proxy struct {
-	LiveConnections map[string]Connection
 	CreateChannel   chan []Connection
 	KillChannel     chan []Connection
 	Backend         backends.ReadOnly
+
+	// Route, session and backend events, see Subscribe
+	Events          *EventBus
+
+	Logger          *slog.Logger
+
+	// Where the last applied connections are saved, to fall back on when the backend is down at startup
+	SnapshotPath    string
+
+	// Holds back updates removing too many routes at once
+	Guard           DeletionGuard
+
+	// How long Shutdown reports unhealthy before it stops accepting clients, for load balancers to notice first
+	ShutdownDelay   time.Duration
+
+	// Updates come from the poller, reloads and the admin endpoints, and take turns
+	updateLock      sync.Mutex
+
+	// The live connections by url. Updates replace the map rather than modify it, so the map returned
+	// by connections can be read without holding the lock, see Routes
+	liveLock        sync.RWMutex
+	live            map[string]Connection
+
+	// Whether the connections come from the snapshot, or an update is held by the guard
+	stateLock       sync.RWMutex
+	staleSince      time.Time
+	held            *HeldChange
+	draining        bool
+
+	// Closed to stop polling, see Shutdown
+	quit            chan struct{}
+	stopOnce        sync.Once
 }
 
-func RunProxy(backend backends.ReadOnly, logLevel int, callback func(c *Proxy)) error {
-	proxy := &Proxy{
-		LiveConnections: make(map[string]Connection),
+func CreateProxy(backend backends.ReadOnly) *Proxy {
+	return &Proxy{
+		live: make(map[string]Connection),
 		CreateChannel: make(chan []Connection, 1),
 		KillChannel: make(chan []Connection, 1),
 		Backend: backend,
+		Events: CreateEventBus(),
+		Logger: slog.Default(),
+		quit: make(chan struct{}),
 	}
+}
+
+// Subscribe calls handler with every event of the proxy until the returned function is called.
+func (c *Proxy) Subscribe(handler func(Event)) func() {
+	return c.Events.Subscribe(handler)
+}
 
-	return proxy.Run(logLevel, func() {
+func RunProxy(backend backends.ReadOnly, logger *slog.Logger, callback func(c *Proxy)) error {
+	proxy := CreateProxy(backend)
+	proxy.Logger = logger
+
+	return proxy.Run(func() {
 		callback(proxy)
 	})
 }
 
-func diffProxies(logLevel int, newProxyList []backends.ConnectionConfig, live map[string]Connection) ([]Connection, []Connection, map[string]Connection, error) {
+// routeUpdate is a live connection whose attributes changed without its url changing, err is why the
+// new configuration was rejected and the previous one kept.
+type routeUpdate struct {
+	previous backends.ConnectionConfig
+	config   backends.ConnectionConfig
+	err      error
+}
+
+func diffProxies(logger *slog.Logger, newProxyList []backends.ConnectionConfig, live map[string]Connection) ([]Connection, []Connection, []routeUpdate, map[string]Connection, error) {
 
 	// This is essentially set difference :/
 
@@ -36,13 +103,32 @@ func diffProxies(logLevel int, newProxyList []backends.ConnectionConfig, live ma
 	toCreate := make([]Connection, 0)
 	toRetain := make([]Connection, 0)
 	toKill := make([]Connection, 0)
+	updated := make([]routeUpdate, 0)
 
 	// Found out which connections to retain or create
 	for i := range newProxyList {
 		connectionsConfigMap[newProxyList[i].Url] = newProxyList[i]
 
-		if _, ok := live[newProxyList[i].Url]; ok {
-			toRetain = append(toRetain, Connection{config: newProxyList[i], channel: live[newProxyList[i].Url].channel})
+		if existing, ok := live[newProxyList[i].Url]; ok {
+			// The attributes of a connection can change without its url changing
+			if !reflect.DeepEqual(existing.config, newProxyList[i]) {
+				if err := existing.route.set(newProxyList[i]); err != nil {
+					logger.Warn("Keeping the previous configuration of an invalid connection", "route", newProxyList[i].Url, "error", err)
+					updated = append(updated, routeUpdate{previous: existing.config, config: newProxyList[i], err: err})
+					toRetain = append(toRetain, existing)
+					continue
+				}
+
+				updated = append(updated, routeUpdate{previous: existing.config, config: newProxyList[i]})
+
+				// Sessions left on a demoted primary would keep writing to what is now a replica
+				if newProxyList[i].EndSessionsOnRetarget && !reflect.DeepEqual(existing.config.Upstreams(), newProxyList[i].Upstreams()) {
+					logger.Info("Ending the sessions of a retargeted connection", "route", newProxyList[i].Url, "upstream", newProxyList[i].RemoteAddress)
+					existing.route.terminateSessions(ReasonRetargeted)
+				}
+			}
+
+			toRetain = append(toRetain, Connection{config: newProxyList[i], channel: existing.channel, route: existing.route})
 		} else {
 			toCreate = append(toCreate, Connection{config: newProxyList[i], channel: nil})
 		}
@@ -61,83 +147,445 @@ func diffProxies(logLevel int, newProxyList []backends.ConnectionConfig, live ma
 		newLive[toRetain[i].config.Url] = toRetain[i]
 	}
 
+	created := make([]Connection, 0, len(toCreate))
+
 	for i := range toCreate {
+		r, err := newRoute(toCreate[i].config)
+
+		// Left out of the live connections, so it is retried on the next poll
+		if err != nil {
+			logger.Warn("Not creating invalid connection", "route", toCreate[i].config.Url, "error", err)
+			continue
+		}
+
 		toCreate[i].channel = make(chan bool)
+		toCreate[i].route = r
 
 		newLive[toCreate[i].config.Url] = toCreate[i]
+		created = append(created, toCreate[i])
+	}
+
+	toCreate = created
+
+	logger.Debug("Diffed connections", "retain", connectionUrlsOf(toRetain), "create", connectionUrlsOf(toCreate), "kill", connectionUrlsOf(toKill))
+
+	return toCreate, toKill, updated, newLive, nil
+}
+
+func connectionUrlsOf(connections []Connection) []string {
+	urls := make([]string, len(connections))
+
+	for i := range connections {
+		urls[i] = connections[i].config.Url
+	}
+
+	return urls
+}
+
+func (c *Proxy) UpdateConnections() error {
+	// Polls leave a held update to the next ones, only a reload reports it
+	if _, err := c.update(context.Background()); err != nil && err != errHeld {
+		return err
 	}
 
-	if logLevel > 0 {
-		if logLevel > 1 {
-			log.Println("Connections", newProxyList)
+	return nil
+}
+
+// update applies the connections of the backend, returning whether that changed them, see ReloadApplied.
+func (c *Proxy) update(ctx context.Context) (outcome string, err error) {
+	c.updateLock.Lock()
+	defer c.updateLock.Unlock()
+
+	// The listeners closed by Shutdown stay closed
+	select {
+	case <-c.quit:
+		return ReloadRejected, errShuttingDown
+	default:
+	}
+
+	ctx, span := tracer().Start(ctx, "poll", trace.WithAttributes(attribute.String("tcpproxy.backend", fmt.Sprintf("%T", c.Backend))))
+	defer func() { endSpan(span, err) }()
+
+	connections, err := backends.GetProxyConfigurationsWithContext(ctx, c.Backend)
+
+	if err != nil {
+		c.Logger.Error("Error fetching connections from the backend", "error", err)
+		c.Events.Publish(Event{Type: PollFailed, Error: errorString(err)})
+
+		// The routes stay as they are, no more recent than the last time a source of the backend answered
+		var stale *backends.StaleError
+
+		if errors.As(err, &stale) {
+			c.markStale(stale.Since)
 		}
 
-		log.Println("Retain", toRetain)
-		log.Println("Create", toCreate)
-		log.Println("Kill  ", toKill)
+		return ReloadRejected, err
 	}
 
-	return toCreate, toKill, newLive, nil
+	span.SetAttributes(attribute.Int("tcpproxy.connections", len(connections)))
+
+	// Only updates replace the live connections, and this one holds the update lock
+	live := c.connections()
+
+	if removed, suspicious := c.Guard.suspicious(connections, live); suspicious {
+		c.stateLock.Lock()
+		held, confirmed := c.Guard.hold(c.held, connections, len(live), removed)
+		c.held = held
+		c.stateLock.Unlock()
+
+		if !confirmed {
+			span.SetAttributes(attribute.Bool("tcpproxy.held", true), attribute.Int("tcpproxy.removed", removed))
+			c.Logger.Warn("Holding an update removing too many connections", "removed", removed, "live", len(live), "polls", held.Polls, "required_polls", c.Guard.Polls)
+			return ReloadRejected, errHeld
+		}
+
+		c.Logger.Warn("Applying a held update, confirmed by consecutive polls", "removed", removed, "live", len(live), "polls", held.Polls)
+	}
+
+	c.setHeld(nil)
+
+	outcome = ReloadApplied
+
+	if sameConnections(connections, live) {
+		outcome = ReloadUnchanged
+	}
+
+	if err := c.applyConnections(connections); err != nil {
+		return ReloadRejected, err
+	}
+
+	c.setStale(time.Time{})
+
+	// An unchanged poll leaves the snapshot as it is, rather than writing it out on every one
+	if c.SnapshotPath != "" && outcome == ReloadApplied {
+		if err := saveSnapshot(c.SnapshotPath, connections); err != nil {
+			c.Logger.Error("Error saving the snapshot", "path", c.SnapshotPath, "error", err)
+		}
+	}
+
+	return outcome, nil
 }
 
-func (c *Proxy) UpdateConnections(logLevel int) error {
-	connections, err := c.Backend.GetProxyConfigurations()
+// sameConnections reports whether applying connections would leave the live ones as they are.
+func sameConnections(connections []backends.ConnectionConfig, live map[string]Connection) bool {
+	if len(connections) != len(live) {
+		return false
+	}
+
+	for i := range connections {
+		existing, ok := live[connections[i].Url]
 
-	if logLevel > 1 {
-		log.Println("Got connections...")
-		log.Println("Live", c.LiveConnections)
+		if !ok || !reflect.DeepEqual(existing.config, connections[i]) {
+			return false
+		}
 	}
 
+	return true
+}
+
+func (c *Proxy) applyConnections(connections []backends.ConnectionConfig) error {
+	var toCreate []Connection
+	var toKill   []Connection
+
+	toCreate, toKill, updated, live, err := diffProxies(c.Logger, connections, c.connections())
+	c.setConnections(live)
+
 	if err != nil {
-		log.Println("Error fetching proxies from backend %", err)
 		return err
-	} else {
-		var toCreate []Connection
-		var toKill   []Connection
+	}
 
-		toCreate, toKill, live, err := diffProxies(logLevel, connections, c.LiveConnections)
-		c.LiveConnections = live
+	for i := range toCreate {
+		toCreate[i].route.events = c.Events
 
-		if err != nil {
-			return err
-		}
+		// Claimed now rather than by the listener, so the unclaimed ones can be closed after the first update
+		toCreate[i].route.inherited, _ = inherited.take(toCreate[i].config.LocalAddress)
+	}
 
-		if logLevel > 2 {
-			log.Println("live", c.LiveConnections)
+	c.KillChannel <- toKill
+	c.CreateChannel <- toCreate
+
+	for i := range toKill {
+		c.Events.Publish(Event{Type: RouteKilled, Route: toKill[i].config.Url, Local: toKill[i].config.LocalAddress})
+	}
+
+	for i := range toCreate {
+		c.Events.Publish(Event{Type: RouteCreated, Route: toCreate[i].config.Url, Local: toCreate[i].config.LocalAddress})
+	}
+
+	for i := range updated {
+		event := Event{Type: RouteUpdated, Route: updated[i].config.Url, Local: updated[i].config.LocalAddress, Reason: ReloadApplied, Previous: &updated[i].previous, Config: &updated[i].config}
+
+		if updated[i].err != nil {
+			event.Reason = ReloadRejected
+			event.Error = errorString(updated[i].err)
 		}
 
-		c.KillChannel <- toKill
-		c.CreateChannel <- toCreate
+		c.Events.Publish(event)
 	}
 
 	return nil
 }
 
-func (c *Proxy) Run(logLevel int, callback func()) error {
+// Listeners returns the listeners of the live connections by their local address, to hand over to an upgrade.
+func (c *Proxy) Listeners() map[string]net.Listener {
+	listeners := make(map[string]net.Listener)
+
+	for _, connection := range c.connections() {
+		if connection.route == nil {
+			continue
+		}
+
+		connection.route.RLock()
+
+		if connection.route.listener != nil && !connection.route.closing {
+			listeners[connection.config.LocalAddress] = connection.route.listener
+		}
 
-	if logLevel > 0 {
-		log.Println("Initialising connections")
+		connection.route.RUnlock()
 	}
 
-	err := c.UpdateConnections(logLevel)
+	return listeners
+}
+
+// connections returns the live connections, which must not be modified.
+func (c *Proxy) connections() map[string]Connection {
+	c.liveLock.RLock()
+	defer c.liveLock.RUnlock()
+
+	return c.live
+}
+
+func (c *Proxy) setConnections(live map[string]Connection) {
+	c.liveLock.Lock()
+	defer c.liveLock.Unlock()
+
+	c.live = live
+}
+
+// WaitListening waits for the listeners of the live connections to be up, or to have failed, so an upgrade
+// is only reported ready once every route is taken over. Routes reports why one couldn't listen.
+func (c *Proxy) WaitListening(ctx context.Context) error {
+	ticker := time.NewTicker(listenCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		pending := 0
+
+		for _, connection := range c.connections() {
+			if connection.route != nil && !connection.route.settled() {
+				pending++
+			}
+		}
+
+		if pending == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Routes returns a snapshot of the live routes, ordered by url.
+func (c *Proxy) Routes() []RouteInfo {
+	live := c.connections()
+	routes := make([]RouteInfo, 0, len(live))
+
+	for _, connection := range live {
+		info := RouteInfo{Url: connection.config.Url, Local: connection.config.LocalAddress, Config: connection.config}
+
+		if connection.route != nil {
+			connection.route.RLock()
+			info.Listening = connection.route.listener != nil && !connection.route.closing
+			info.Error = errorString(connection.route.listenErr)
+			info.Sessions = len(connection.route.sessions)
+			connection.route.RUnlock()
+		}
+
+		routes = append(routes, info)
+	}
+
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Url < routes[j].Url })
+
+	return routes
+}
+
+// Sessions returns a snapshot of the sessions of the live routes, oldest first.
+func (c *Proxy) Sessions() []SessionInfo {
+	sessions := make([]SessionInfo, 0)
+
+	for _, connection := range c.connections() {
+		if connection.route == nil {
+			continue
+		}
+
+		connection.route.RLock()
+
+		for s := range connection.route.sessions {
+			sessions = append(sessions, s.info(connection.config))
+		}
+
+		connection.route.RUnlock()
+	}
+
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Started.Before(sessions[j].Started) })
+
+	return sessions
+}
+
+// Stale reports whether the connections come from a snapshot rather than the backend, or from the last
+// routes of a backend whose sources all fail, and since when.
+func (c *Proxy) Stale() (bool, time.Time) {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+
+	return !c.staleSince.IsZero(), c.staleSince
+}
+
+func (c *Proxy) setStale(since time.Time) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	c.staleSince = since
+}
+
+// markStale sets since as when the connections went stale, unless they already were.
+func (c *Proxy) markStale(since time.Time) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	if c.staleSince.IsZero() {
+		c.staleSince = since
+	}
+}
+
+// Held returns the update held back by the guard, or nil when there isn't one.
+func (c *Proxy) Held() *HeldChange {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+
+	if c.held == nil {
+		return nil
+	}
+
+	held := *c.held
+
+	return &held
+}
+
+func (c *Proxy) setHeld(held *HeldChange) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	c.held = held
+}
+
+// runFromSnapshot applies the snapshot, then retries the backend until its routes are applied.
+func (c *Proxy) runFromSnapshot(quit chan struct{}) error {
+	saved, err := loadSnapshot(c.SnapshotPath)
+
+	if err != nil {
+		return err
+	}
+
+	c.updateLock.Lock()
+	err = c.applyConnections(saved.Connections)
+	c.updateLock.Unlock()
+
 	if err != nil {
 		return err
 	}
 
-	quit := make(chan struct {})
+	c.setStale(saved.Time)
+
+	c.Logger.Warn("Backend unavailable, running from the snapshot", "path", c.SnapshotPath, "connections", len(saved.Connections), "snapshot_time", saved.Time)
+
+	go func() {
+		delay := snapshotRetryDelay
+
+		for {
+			select {
+			case <-quit:
+				return
+			case <-time.After(delay):
+			}
+
+			if stale, _ := c.Stale(); !stale {
+				return
+			}
+
+			// Logged by the update. One held by the guard leaves the snapshot in place, the retries count
+			// towards confirming it
+			c.UpdateConnections()
+
+			if stale, _ := c.Stale(); !stale {
+				c.Logger.Info("Backend available again, no longer running from the snapshot")
+				return
+			}
+
+			if delay *= 2; delay > time.Minute {
+				delay = time.Minute
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (c *Proxy) Run(callback func()) error {
+	if err := c.start(context.Background()); err != nil {
+		return err
+	}
+
+	callback()
+
+	c.stopPolling()
+
+	return nil
+
+}
+
+// start applies the first update, from the snapshot when the backend is down, then polls the backend.
+func (c *Proxy) start(ctx context.Context) error {
+
+	c.Logger.Info("Initialising connections")
+
+	quit := c.quit
+
+	_, err := c.update(ctx)
+	if err == errHeld {
+		err = nil
+	}
+
+	if err != nil {
+		if c.SnapshotPath == "" {
+			return err
+		}
+
+		if snapshotErr := c.runFromSnapshot(quit); snapshotErr != nil {
+			c.Logger.Error("Error running from the snapshot", "path", c.SnapshotPath, "error", snapshotErr)
+			return err
+		}
+	}
+
+	// Whatever the upgraded process listened on that this one doesn't route is left to no one
+	inherited.closeUnused(c.Logger)
 
 	if c.Backend.IsPollable() {
 
 		go func() {
-			timer := time.NewTicker(time.Minute)
+			timer := time.NewTicker(pollInterval)
 			for {
 				select {
 				case <-quit:
 					return
 				case <-timer.C:
-					err := c.UpdateConnections(logLevel)
+					err := c.UpdateConnections()
 					if err != nil {
-						log.Println("Error Updating Connections ", err)
+						c.Logger.Error("Error updating connections", "error", err)
 					}
 				}
 
@@ -145,10 +593,22 @@ func (c *Proxy) Run(logLevel int, callback func()) error {
 		}()
 	}
 
-	callback()
+	if watchable, ok := c.Backend.(backends.Watchable); ok {
 
-	close(quit)
+		go func() {
+			for {
+				select {
+				case <-quit:
+					return
+				case <-watchable.Changes():
+					err := c.UpdateConnections()
+					if err != nil {
+						c.Logger.Error("Error updating connections", "error", err)
+					}
+				}
+			}
+		}()
+	}
 
 	return nil
-
 }
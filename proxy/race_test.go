@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+// Meant for go test -race, the routes churn while they are polled, reloaded, read and connected to.
+func TestConcurrentRouteChurn(t *testing.T) {
+	upstreamPort := echoUpstream(t)
+
+	ports := make([]string, 4)
+	urls := make([]string, len(ports))
+
+	for i := range ports {
+		ports[i] = freePort()
+		urls[i] = ports[i] + ":127.0.0.1:" + upstreamPort
+	}
+
+	backend := &flakyBackend{connections: strings.Join(urls, ",")}
+
+	server, err := New(WithBackend(backend), WithLogger(slog.New(slog.DiscardHandler)))
+	assert.Nil(t, err)
+	assert.Nil(t, server.Start(context.Background()))
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	churn := func(update func()) {
+		defer wg.Done()
+
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			// Every other update drops all but the first route, then brings them back
+			backend.Lock()
+			if i % 2 == 0 {
+				backend.connections = urls[0]
+			} else {
+				backend.connections = strings.Join(urls, ",")
+			}
+			backend.Unlock()
+
+			update()
+		}
+	}
+
+	read := func() {
+		defer wg.Done()
+
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			for _, route := range server.Routes() {
+				assert.NotEmpty(t, route.Url)
+			}
+
+			server.Sessions()
+			server.Proxy().Listeners()
+			server.Proxy().Held()
+		}
+	}
+
+	clients := func() {
+		defer wg.Done()
+
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			// The route may be gone, only the first one stays throughout
+			conn, err := net.DialTimeout("tcp", "127.0.0.1:" + ports[i % len(ports)], time.Second)
+			if err != nil {
+				continue
+			}
+
+			conn.SetDeadline(time.Now().Add(time.Second))
+			conn.Write([]byte("ping"))
+			conn.Read(make([]byte, 4))
+			conn.Close()
+		}
+	}
+
+	wg.Add(5)
+	go churn(func() { server.Proxy().UpdateConnections() })
+	go churn(func() { server.Reload() })
+	go read()
+	go read()
+	go clients()
+
+	time.Sleep(500 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	// The first route was never removed, so it still proxies
+	backend.Lock()
+	backend.connections = strings.Join(urls, ",")
+	backend.Unlock()
+
+	_, err = server.Reload()
+	assert.Nil(t, err)
+
+	conn := connect(t, "127.0.0.1:" + ports[0])
+	echo(t, conn, "hello")
+	conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	assert.Nil(t, server.Shutdown(ctx))
+
+	// Shutdown waits for the listeners, so none of the ports are taken any more
+	for _, port := range ports {
+		listener, err := net.Listen("tcp", ":" + port)
+		assert.Nil(t, err)
+
+		if err == nil {
+			listener.Close()
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"github.com/brandnetworks/tcpproxy/backends"
+)
+
+// The outcomes of a reload, reported as the reason of its config_reloaded event
+const (
+	ReloadApplied   = "applied"
+	ReloadUnchanged = "unchanged"
+	ReloadRejected  = "rejected"
+)
+
+var errHeld = fmt.Errorf("The update removes too many connections, held until consecutive polls confirm it")
+
+// Reload reads the backend again and applies its connections now rather than on the next poll, returning
+// whether that changed the routes. When the backend can't be read, or the guard holds the update back,
+// the reload is rejected and the routes are left as they were.
+func (c *Proxy) Reload() (outcome string, err error) {
+	defer func() { c.reloaded(outcome, err) }()
+
+	if reloadable, ok := c.Backend.(backends.Reloadable); ok {
+		if err := reloadable.Reload(); err != nil {
+			return ReloadRejected, err
+		}
+	}
+
+	return c.update(context.Background())
+}
+
+func (c *Proxy) reloaded(outcome string, err error) {
+	if err != nil {
+		c.Logger.Error("Rejected the reloaded configuration", "error", err)
+	} else {
+		c.Logger.Info("Reloaded the configuration", "outcome", outcome)
+	}
+
+	c.Events.Publish(Event{Type: ConfigReloaded, Reason: outcome, Error: errorString(err)})
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+	"github.com/brandnetworks/tcpproxy/backends/static"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "connections")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("# The database\n8001:example.com:5431\n"), 0644))
+
+	backend, err := static.CreateStaticFileBackend(path)
+	assert.Nil(t, err)
+
+	proxy := CreateProxy(backend)
+	drain(proxy)
+
+	var lock sync.Mutex
+	reloads := make([]Event, 0)
+
+	proxy.Subscribe(func(event Event) {
+		if event.Type == ConfigReloaded {
+			lock.Lock()
+			reloads = append(reloads, event)
+			lock.Unlock()
+		}
+	})
+
+	assert.Nil(t, proxy.UpdateConnections())
+	assert.Len(t, proxy.Routes(), 1)
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("8001:example.com:5431\n8002:example.com:5432, 8003:example.com:5433 # The caches\n"), 0644))
+
+	outcome, err := proxy.Reload()
+	assert.Nil(t, err)
+	assert.Equal(t, ReloadApplied, outcome)
+	assert.Len(t, proxy.Routes(), 3)
+
+	outcome, err = proxy.Reload()
+	assert.Nil(t, err)
+	assert.Equal(t, ReloadUnchanged, outcome)
+
+	// The routes of the last good file are kept
+	assert.Nil(t, ioutil.WriteFile(path, []byte("8001:example.com\n"), 0644))
+
+	outcome, err = proxy.Reload()
+	assert.NotNil(t, err)
+	assert.Equal(t, ReloadRejected, outcome)
+	assert.Len(t, proxy.Routes(), 3)
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	assert.Len(t, reloads, 3)
+	assert.Equal(t, []string{ReloadApplied, ReloadUnchanged, ReloadRejected}, []string{reloads[0].Reason, reloads[1].Reason, reloads[2].Reason})
+	assert.Empty(t, reloads[1].Error)
+	assert.NotEmpty(t, reloads[2].Error)
+}
+
+func TestReloadHeld(t *testing.T) {
+	backend := &flakyBackend{connections: "8001:example.com:5431,8002:example.com:5432"}
+	proxy := CreateProxy(backend)
+	proxy.Guard = DeletionGuard{MaxRemovedPercent: 0, Polls: 2, Interval: time.Nanosecond}
+	drain(proxy)
+
+	assert.Nil(t, proxy.UpdateConnections())
+
+	backend.connections = ""
+
+	// A held update is a rejected reload, until enough of them confirm it
+	outcome, err := proxy.Reload()
+	assert.Equal(t, errHeld, err)
+	assert.Equal(t, ReloadRejected, outcome)
+	assert.Len(t, proxy.Routes(), 2)
+
+	outcome, err = proxy.Reload()
+	assert.Nil(t, err)
+	assert.Equal(t, ReloadApplied, outcome)
+	assert.Empty(t, proxy.Routes())
+}
@@ -0,0 +1,363 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+	"github.com/brandnetworks/tcpproxy/backends"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const defaultDialTimeout = 1 * time.Minute
+
+// route holds the configuration a listener proxies with. It is shared between
+// the listener and the poller, so attribute changes to a retained connection
+// apply to new sessions without rebinding the local port.
+type route struct {
+	sync.RWMutex
+	config  backends.ConnectionConfig
+	allowed []*net.IPNet
+	tls     *tls.Config
+	err     error
+
+	events    *EventBus
+	unhealthy map[string]bool
+	sessions  map[*session]struct{}
+
+	// Closed without ending the sessions when the proxy shuts down
+	listener  net.Listener
+	closing   bool
+
+	// Why the route couldn't listen, it is left without a listener then
+	listenErr error
+
+	// Taken over from the process this one upgraded from, rather than listening anew
+	inherited net.Listener
+}
+
+func newRoute(config backends.ConnectionConfig) (*route, error) {
+	r := &route{}
+
+	if err := r.set(config); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// set replaces the configuration, leaving the previous one in place if the new one is invalid.
+func (r *route) set(config backends.ConnectionConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	allowed := make([]*net.IPNet, len(config.AllowedCIDRs))
+
+	for i := range config.AllowedCIDRs {
+		_, network, err := net.ParseCIDR(config.AllowedCIDRs[i])
+
+		if err != nil {
+			return err
+		}
+
+		allowed[i] = network
+	}
+
+	tlsConfig, err := clientTLSConfig(config.TLS)
+
+	if err != nil {
+		return err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	r.config = config
+	r.allowed = allowed
+	r.tls = tlsConfig
+	r.err = nil
+
+	return nil
+}
+
+func (r *route) current() backends.ConnectionConfig {
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.config
+}
+
+func clientTLSConfig(config *backends.TLSConfig) (*tls.Config, error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+
+	if config.CAFile != "" {
+		pem, err := ioutil.ReadFile(config.CAFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", config.CAFile)
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// allows checks the client address against the allowed CIDRs, an empty list allows everyone.
+func (r *route) allows(addr net.Addr) bool {
+	r.RLock()
+	defer r.RUnlock()
+
+	if r.err != nil {
+		return false
+	}
+
+	if len(r.allowed) == 0 {
+		return true
+	}
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+
+	if !ok {
+		return false
+	}
+
+	for _, network := range r.allowed {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dial connects to the first reachable upstream, trying them in order of preference.
+func (r *route) dial(ctx context.Context, logger *slog.Logger) (net.Conn, error) {
+	r.RLock()
+	config := r.config
+	tlsConfig := r.tls
+	r.RUnlock()
+
+	timeout := config.DialTimeout
+
+	if timeout == 0 {
+		timeout = defaultDialTimeout
+	}
+
+	var lastErr error
+
+	for _, target := range orderTargets(config.Upstreams()) {
+		logger.Debug("Connecting", "upstream", target.Address)
+
+		conn, err := dialTarget(ctx, target.Address, tlsConfig, timeout)
+
+		if err != nil {
+			logger.Warn("Error connecting", "upstream", target.Address, "error", err)
+			r.failed(config, target.Address, err)
+			lastErr = err
+			continue
+		}
+
+		r.setHealthy(config, target.Address, true)
+
+		return conn, nil
+	}
+
+	return nil, lastErr
+}
+
+// dialTarget resolves and connects to a single upstream, completing the TLS handshake when the route uses TLS.
+func dialTarget(ctx context.Context, address string, tlsConfig *tls.Config, timeout time.Duration) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// The timeout covers the lookup and every address it returns, as with net.DialTimeout
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	addresses := []string{host}
+
+	if net.ParseIP(host) == nil {
+		if addresses, err = resolve(ctx, host); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, span := tracer().Start(ctx, "dial", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("server.address", host),
+		attribute.String("server.port", port),
+		attribute.Bool("tcpproxy.tls", tlsConfig != nil),
+	))
+
+	conn, err := dialAddresses(ctx, addresses, port)
+
+	if err == nil {
+		span.SetAttributes(attribute.String("network.peer.address", conn.RemoteAddr().String()))
+
+		if tlsConfig != nil {
+			conn, err = handshake(conn, address, tlsConfig, timeout)
+		}
+	}
+
+	endSpan(span, err)
+
+	return conn, err
+}
+
+func resolve(ctx context.Context, host string) ([]string, error) {
+	ctx, span := tracer().Start(ctx, "dns", trace.WithAttributes(attribute.String("server.address", host)))
+
+	addresses, err := net.DefaultResolver.LookupHost(ctx, host)
+
+	if err == nil {
+		span.SetAttributes(attribute.StringSlice("tcpproxy.addresses", addresses))
+	}
+
+	endSpan(span, err)
+
+	return addresses, err
+}
+
+// dialAddresses connects to the first of the resolved addresses that answers.
+func dialAddresses(ctx context.Context, addresses []string, port string) (net.Conn, error) {
+	var dialer net.Dialer
+	var lastErr error
+
+	for _, address := range addresses {
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(address, port))
+
+		if err == nil {
+			return conn, nil
+		}
+
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
+
+func (r *route) failed(config backends.ConnectionConfig, address string, err error) {
+	r.events.Publish(Event{Type: DialFailed, Route: config.Url, Local: config.LocalAddress, Target: address, Error: errorString(err)})
+	r.setHealthy(config, address, false)
+}
+
+// setHealthy tracks whether the last dial to a target succeeded, publishing the changes.
+func (r *route) setHealthy(config backends.ConnectionConfig, address string, healthy bool) {
+	r.Lock()
+
+	if r.unhealthy == nil {
+		r.unhealthy = make(map[string]bool)
+	}
+
+	changed := r.unhealthy[address] == healthy
+
+	if healthy {
+		delete(r.unhealthy, address)
+	} else {
+		r.unhealthy[address] = true
+	}
+
+	r.Unlock()
+
+	if changed {
+		r.events.Publish(Event{Type: HealthChanged, Route: config.Url, Local: config.LocalAddress, Target: address, Healthy: &healthy})
+	}
+}
+
+func handshake(conn net.Conn, address string, config *tls.Config, timeout time.Duration) (net.Conn, error) {
+	config = config.Clone()
+
+	if config.ServerName == "" {
+		host, _, _ := net.SplitHostPort(address)
+		config.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(timeout))
+
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	tlsConn.SetDeadline(time.Time{})
+
+	return tlsConn, nil
+}
+
+// orderTargets sorts targets by priority and shuffles each priority by weight,
+// so the first target is the one to use and the rest are the fallbacks.
+func orderTargets(targets []backends.Target) []backends.Target {
+	ordered := make([]backends.Target, len(targets))
+	copy(ordered, targets)
+
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].Priority < ordered[j].Priority
+	})
+
+	for start := 0; start < len(ordered); {
+		end := start
+
+		for end < len(ordered) && ordered[end].Priority == ordered[start].Priority {
+			end++
+		}
+
+		weightedShuffle(ordered[start:end])
+		start = end
+	}
+
+	return ordered
+}
+
+func weightedShuffle(targets []backends.Target) {
+	for i := range targets {
+		total := 0
+
+		for _, target := range targets[i:] {
+			total += weight(target)
+		}
+
+		pick := rand.Intn(total)
+
+		for j := i; j < len(targets); j++ {
+			pick -= weight(targets[j])
+
+			if pick < 0 {
+				targets[i], targets[j] = targets[j], targets[i]
+				break
+			}
+		}
+	}
+}
+
+// Zero weights still get picked occasionally, as with SRV records
+func weight(target backends.Target) int {
+	if target.Weight <= 0 {
+		return 1
+	}
+
+	return target.Weight * 100
+}
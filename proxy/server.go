@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+	"github.com/brandnetworks/tcpproxy/backends"
+)
+
+var (
+	errNoBackend  = fmt.Errorf("A backend is required, see WithBackend")
+	errStarted    = fmt.Errorf("The server has already been started")
+	errNotStarted = fmt.Errorf("The server hasn't been started")
+)
+
+// RouteInfo is a live route as returned by Server.Routes, Listening is false until its listener is up
+// and again once the proxy shuts down. Error is why it couldn't listen.
+type RouteInfo struct {
+	Url       string                    `json:"url"`
+	Local     string                    `json:"local"`
+	Config    backends.ConnectionConfig `json:"config"`
+	Listening bool                      `json:"listening"`
+	Sessions  int                       `json:"sessions"`
+	Error     string                    `json:"error,omitempty"`
+}
+
+// SessionInfo is a session of a live route as returned by Server.Sessions, Upstream is empty while it dials.
+type SessionInfo struct {
+	ID       string    `json:"id"`
+	Route    string    `json:"route"`
+	Local    string    `json:"local"`
+	Client   string    `json:"client"`
+	Upstream string    `json:"upstream,omitempty"`
+	Started  time.Time `json:"started"`
+}
+
+// Server embeds the proxy in another program. It proxies the routes of its backend from Start until Shutdown,
+// and its methods are safe for concurrent use. A route failing to listen once started, like one a later poll
+// adds on a busy port, is left out of the listening routes and published as a listen_failed event.
+type Server struct {
+	proxy *Proxy
+
+	lock     sync.Mutex
+	started  bool
+	stopped  chan struct{}
+	stopOnce sync.Once
+
+	// Closed once the listeners of the routes have returned
+	done     chan struct{}
+}
+
+// Option configures a Server, see New.
+type Option func(*Server)
+
+// WithBackend sets where the routes come from, it is the one option New requires.
+func WithBackend(backend backends.ReadOnly) Option {
+	return func(s *Server) {
+		s.proxy.Backend = backend
+	}
+}
+
+// WithLogger sets the logger, slog.Default() otherwise.
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Server) {
+		s.proxy.Logger = logger
+	}
+}
+
+// WithSnapshot saves the applied routes to path, to start from when the backend is down.
+func WithSnapshot(path string) Option {
+	return func(s *Server) {
+		s.proxy.SnapshotPath = path
+	}
+}
+
+// WithGuard holds back updates removing too many routes at once.
+func WithGuard(guard DeletionGuard) Option {
+	return func(s *Server) {
+		s.proxy.Guard = guard
+	}
+}
+
+// WithShutdownDelay keeps accepting clients for delay once Shutdown reports unhealthy, see Proxy.ShutdownDelay.
+func WithShutdownDelay(delay time.Duration) Option {
+	return func(s *Server) {
+		s.proxy.ShutdownDelay = delay
+	}
+}
+
+// New creates a Server configured by opts, failing without a backend.
+func New(opts ...Option) (*Server, error) {
+	s := &Server{
+		proxy: CreateProxy(nil),
+		stopped: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.proxy.Backend == nil {
+		return nil, errNoBackend
+	}
+
+	return s, nil
+}
+
+// Start applies the routes of the backend and listens on them, then keeps polling the backend in the
+// background. ctx bounds the first poll, when it fails the snapshot is used if there is one. It returns
+// once every route is listening, so the server can be reported ready straight away. When one of them
+// can't listen, the server stops and the error is returned.
+func (s *Server) Start(ctx context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.started {
+		return errStarted
+	}
+
+	s.started = true
+
+	go func() {
+		serveRoutes(s.proxy.Logger, s.proxy.CreateChannel, s.proxy.KillChannel, s.stopped)
+		close(s.done)
+	}()
+
+	err := s.proxy.start(ctx)
+
+	if err == nil {
+		err = s.waitListening(ctx)
+	}
+
+	if err != nil {
+		s.proxy.stopPolling()
+		s.stop()
+
+		// The listeners are closed by the time it returns, so the caller can retry on the same ports
+		<-s.done
+		return err
+	}
+
+	return nil
+}
+
+// waitListening waits for the listeners of the live routes to be up, or to have failed, returning why
+// the first route by url couldn't listen
+func (s *Server) waitListening(ctx context.Context) error {
+	if err := s.proxy.WaitListening(ctx); err != nil {
+		return err
+	}
+
+	for _, route := range s.proxy.Routes() {
+		if route.Error != "" {
+			return fmt.Errorf("Error listening on %s for %s: %s", route.Local, route.Url, route.Error)
+		}
+	}
+
+	return nil
+}
+
+// Shutdown stops polling and accepting clients, then waits for the sessions to end. Sessions still
+// running once ctx is done are closed, and its error is returned. The listeners have all returned and
+// the backend is closed by the time it does, see backends.Closeable.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.proxy.Shutdown(ctx)
+	s.stop()
+
+	s.lock.Lock()
+	started := s.started
+	s.lock.Unlock()
+
+	if started {
+		<-s.done
+	}
+
+	if closeErr := backends.Close(s.proxy.Backend); closeErr != nil {
+		s.proxy.Logger.Warn("Error closing the backend", "error", closeErr)
+	}
+
+	return err
+}
+
+func (s *Server) stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopped)
+	})
+}
+
+// Routes returns a snapshot of the live routes, ordered by url.
+func (s *Server) Routes() []RouteInfo {
+	return s.proxy.Routes()
+}
+
+// Sessions returns a snapshot of the sessions of the live routes, oldest first.
+func (s *Server) Sessions() []SessionInfo {
+	return s.proxy.Sessions()
+}
+
+// Reload applies the routes of the backend now, see Proxy.Reload.
+func (s *Server) Reload() (string, error) {
+	s.lock.Lock()
+	started := s.started
+	s.lock.Unlock()
+
+	if !started {
+		s.proxy.reloaded(ReloadRejected, errNotStarted)
+		return ReloadRejected, errNotStarted
+	}
+
+	return s.proxy.Reload()
+}
+
+// Subscribe calls handler with every event of the proxy until the returned function is called.
+func (s *Server) Subscribe(handler func(Event)) func() {
+	return s.proxy.Subscribe(handler)
+}
+
+// Proxy returns the proxy the server runs, for the status endpoints and upgrades.
+func (s *Server) Proxy() *Proxy {
+	return s.proxy
+}
@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer(t *testing.T) {
+	upstreamPort := echoUpstream(t)
+	localPort := freePort()
+	backend := &flakyBackend{connections: localPort + ":127.0.0.1:" + upstreamPort}
+
+	_, err := New(WithLogger(slog.New(slog.DiscardHandler)))
+	assert.Equal(t, errNoBackend, err)
+
+	server, err := New(WithBackend(backend), WithLogger(slog.New(slog.DiscardHandler)))
+	assert.Nil(t, err)
+
+	_, err = server.Reload()
+	assert.Equal(t, errNotStarted, err)
+
+	assert.Nil(t, server.Start(context.Background()))
+	assert.Equal(t, errStarted, server.Start(context.Background()))
+
+	conn := connect(t, "127.0.0.1:" + localPort)
+	defer conn.Close()
+	echo(t, conn, "hello")
+
+	routes := server.Routes()
+	assert.Len(t, routes, 1)
+	assert.Equal(t, localPort + ":127.0.0.1:" + upstreamPort, routes[0].Url)
+	assert.True(t, routes[0].Listening)
+	assert.Equal(t, 1, routes[0].Sessions)
+
+	sessions := server.Sessions()
+	assert.Len(t, sessions, 1)
+	assert.Equal(t, routes[0].Url, sessions[0].Route)
+	assert.Equal(t, conn.LocalAddr().String(), sessions[0].Client)
+	assert.Equal(t, "127.0.0.1:" + upstreamPort, sessions[0].Upstream)
+
+	secondPort := freePort()
+	backend.Lock()
+	backend.connections += "," + secondPort + ":127.0.0.1:" + upstreamPort
+	backend.Unlock()
+
+	outcome, err := server.Reload()
+	assert.Nil(t, err)
+	assert.Equal(t, ReloadApplied, outcome)
+	assert.Len(t, server.Routes(), 2)
+
+	second := connect(t, "127.0.0.1:" + secondPort)
+	echo(t, second, "second")
+	second.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200 * time.Millisecond)
+	defer cancel()
+
+	// The first session is still open, so it is closed once the timeout passes
+	assert.Equal(t, context.DeadlineExceeded, server.Shutdown(ctx))
+
+	for _, route := range server.Routes() {
+		assert.False(t, route.Listening)
+	}
+
+	outcome, err = server.Reload()
+	assert.Equal(t, errShuttingDown, err)
+	assert.Equal(t, ReloadRejected, outcome)
+}
+
+func TestServerListenFailed(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer taken.Close()
+
+	_, takenPort, _ := net.SplitHostPort(taken.Addr().String())
+	upstreamPort := echoUpstream(t)
+	localPort := freePort()
+
+	backend := &flakyBackend{connections: localPort + ":127.0.0.1:" + upstreamPort}
+	server, err := New(WithBackend(backend), WithLogger(slog.New(slog.DiscardHandler)))
+	assert.Nil(t, err)
+
+	failed := make(chan Event, 1)
+	server.Subscribe(func(event Event) {
+		if event.Type == ListenFailed {
+			failed <- event
+		}
+	})
+
+	assert.Nil(t, server.Start(context.Background()))
+	defer server.Shutdown(context.Background())
+
+	// A route added once started carries on without listening rather than stopping the server
+	backend.Lock()
+	backend.connections += "," + takenPort + ":127.0.0.1:" + upstreamPort
+	backend.Unlock()
+
+	_, err = server.Reload()
+	assert.Nil(t, err)
+
+	select {
+	case event := <-failed:
+		assert.Equal(t, ":" + takenPort, event.Local)
+		assert.NotEmpty(t, event.Error)
+	case <-time.After(5 * time.Second):
+		t.Fatal("No listen_failed event")
+	}
+
+	conn := connect(t, "127.0.0.1:" + localPort)
+	defer conn.Close()
+	echo(t, conn, "hello")
+
+	for _, route := range server.Routes() {
+		assert.Equal(t, route.Local == ":" + localPort, route.Listening)
+	}
+}
+
+func TestServerStartFailsToListen(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer taken.Close()
+
+	_, takenPort, _ := net.SplitHostPort(taken.Addr().String())
+	upstreamPort := echoUpstream(t)
+	localPort := freePort()
+
+	backend := &flakyBackend{connections: localPort + ":127.0.0.1:" + upstreamPort + "," + takenPort + ":127.0.0.1:" + upstreamPort}
+	server, err := New(WithBackend(backend), WithLogger(slog.New(slog.DiscardHandler)))
+	assert.Nil(t, err)
+
+	failed := make(chan Event, 1)
+	server.Subscribe(func(event Event) {
+		if event.Type == ListenFailed {
+			failed <- event
+		}
+	})
+
+	// Start waits for both routes, then fails on the one which can't listen rather than exiting
+	err = server.Start(context.Background())
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), ":" + takenPort)
+	assert.Equal(t, ":" + takenPort, (<-failed).Local)
+
+	// The route which did listen has been stopped
+	free, err := net.Listen("tcp", ":" + localPort)
+	assert.Nil(t, err)
+	free.Close()
+
+	assert.Nil(t, server.Shutdown(context.Background()))
+}
+
+type closingBackend struct {
+	flakyBackend
+	closed bool
+}
+
+func (b *closingBackend) Close() error {
+	b.Lock()
+	defer b.Unlock()
+
+	b.closed = true
+	return nil
+}
+
+func TestServerShutdownClosesBackend(t *testing.T) {
+	backend := &closingBackend{}
+	server, err := New(WithBackend(backend), WithLogger(slog.New(slog.DiscardHandler)))
+	assert.Nil(t, err)
+
+	assert.Nil(t, server.Start(context.Background()))
+	assert.Nil(t, server.Shutdown(context.Background()))
+
+	backend.Lock()
+	assert.True(t, backend.closed)
+	backend.Unlock()
+}
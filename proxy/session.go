@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"sync"
+	"time"
+	"github.com/brandnetworks/tcpproxy/backends"
+)
+
+// Why a session ended
+const (
+	ReasonClientClose   = "client_close"
+	ReasonUpstreamClose = "upstream_close"
+	ReasonIdleTimeout   = "idle_timeout"
+	ReasonKilled        = "killed"
+	ReasonDrain         = "drain"
+	ReasonDialFailed    = "dial_failed"
+	ReasonRetargeted    = "retargeted"
+)
+
+// session is a client proxied to an upstream. The first reason it ends for is the one reported,
+// so closing the connections after a kill doesn't turn it into a client or upstream close.
+type session struct {
+	id      string
+	client  string
+	started time.Time
+
+	lock     sync.Mutex
+	upstream string
+	conns    []net.Conn
+	reason   string
+}
+
+func newSession(client net.Conn) *session {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	return &session{
+		id:      hex.EncodeToString(id),
+		client:  client.RemoteAddr().String(),
+		started: time.Now(),
+		conns:   []net.Conn{client},
+	}
+}
+
+// info is the snapshot of the session returned by Proxy.Sessions.
+func (s *session) info(config backends.ConnectionConfig) SessionInfo {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return SessionInfo{ID: s.id, Route: config.Url, Local: config.LocalAddress, Client: s.client, Upstream: s.upstream, Started: s.started}
+}
+
+func (s *session) connected(upstream net.Conn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.upstream = upstream.RemoteAddr().String()
+	s.conns = append(s.conns, upstream)
+
+	// Terminated while dialing
+	if s.reason != "" {
+		upstream.Close()
+	}
+}
+
+// end records the reason the session ends for, unless it already has one.
+func (s *session) end(reason string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.reason == "" {
+		s.reason = reason
+	}
+}
+
+// terminate ends the session from outside, closing both of its connections.
+func (s *session) terminate(reason string) {
+	s.end(reason)
+
+	s.lock.Lock()
+	conns := s.conns
+	s.lock.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+func (s *session) endReason() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.reason
+}
+
+// copyReason tells why copying from one side stopped, an error other than a timeout is
+// put down to the side being read from, like a clean close.
+func copyReason(err error, fromClient bool) string {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return ReasonIdleTimeout
+	}
+
+	if fromClient {
+		return ReasonClientClose
+	}
+
+	return ReasonUpstreamClose
+}
+
+func (r *route) addSession(s *session) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.sessions == nil {
+		r.sessions = make(map[*session]struct{})
+	}
+
+	r.sessions[s] = struct{}{}
+}
+
+func (r *route) removeSession(s *session) {
+	r.Lock()
+	defer r.Unlock()
+
+	delete(r.sessions, s)
+}
+
+func (r *route) sessionCount() int {
+	r.RLock()
+	defer r.RUnlock()
+
+	return len(r.sessions)
+}
+
+// setListener records the listener of the route, refusing it once the route is closing.
+func (r *route) setListener(listener net.Listener) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.closing {
+		return false
+	}
+
+	r.listener = listener
+
+	return true
+}
+
+func (r *route) failListen(err error) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.listenErr = err
+}
+
+// settled reports whether the route is done trying to listen, whether or not it managed to.
+func (r *route) settled() bool {
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.listener != nil || r.listenErr != nil || r.closing
+}
+
+// closeListener stops the route accepting clients, leaving its sessions running.
+func (r *route) closeListener() {
+	r.Lock()
+	defer r.Unlock()
+
+	r.closing = true
+
+	if r.listener != nil {
+		r.listener.Close()
+	}
+}
+
+func (r *route) isClosing() bool {
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.closing
+}
+
+// terminateSessions ends every session of the route.
+func (r *route) terminateSessions(reason string) {
+	r.RLock()
+	sessions := make([]*session, 0, len(r.sessions))
+
+	for s := range r.sessions {
+		sessions = append(sessions, s)
+	}
+
+	r.RUnlock()
+
+	for _, s := range sessions {
+		s.terminate(reason)
+	}
+}
@@ -0,0 +1,241 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+	"github.com/brandnetworks/tcpproxy/backends"
+	"github.com/stretchr/testify/assert"
+)
+
+// sessionRoute listens on a free port, proxying to an upstream handling each connection with serve.
+func sessionRoute(t *testing.T, idleTimeout time.Duration, serve func(net.Conn)) (string, chan bool, chan Event) {
+	return hostRoute(t, "127.0.0.1", idleTimeout, serve)
+}
+
+// hostRoute is sessionRoute reaching the upstream through host, which may need looking up.
+func hostRoute(t *testing.T, host string, idleTimeout time.Duration, serve func(net.Conn)) (string, chan bool, chan Event) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+
+	free, _ := net.Listen("tcp", "127.0.0.1:0")
+	local := free.Addr().String()
+	free.Close()
+
+	_, upstreamPort, _ := net.SplitHostPort(upstream.Addr().String())
+	_, localPort, _ := net.SplitHostPort(local)
+
+	config, err := backends.ParseConnection(localPort + ":" + host + ":" + upstreamPort)
+	assert.Nil(t, err)
+	config.IdleTimeout = idleTimeout
+
+	r, err := newRoute(*config)
+	assert.Nil(t, err)
+
+	closed := make(chan Event, 1)
+	r.events = CreateEventBus()
+	r.events.Subscribe(func(event Event) {
+		if event.Type == SessionClosed {
+			closed <- event
+		}
+	})
+
+	kill := make(chan bool)
+	go listenRoute(slog.New(slog.DiscardHandler), r, kill)
+
+	t.Cleanup(func() {
+		upstream.Close()
+	})
+
+	return local, kill, closed
+}
+
+func waitClosed(t *testing.T, closed chan Event) Event {
+	t.Helper()
+
+	select {
+	case event := <-closed:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("Session not closed")
+		return Event{}
+	}
+}
+
+func TestSessionEndReasons(t *testing.T) {
+	hold := func(conn net.Conn) {
+		buffer := make([]byte, 64)
+		for {
+			if _, err := conn.Read(buffer); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}
+
+	// The client hangs up
+	local, kill, closed := sessionRoute(t, 0, hold)
+	conn := connect(t, local)
+	conn.Write([]byte("hello"))
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+
+	event := waitClosed(t, closed)
+	assert.Equal(t, ReasonClientClose, event.Reason)
+	assert.Equal(t, int64(5), event.Received)
+	assert.NotEmpty(t, event.Session)
+	close(kill)
+
+	// The upstream hangs up
+	local, kill, closed = sessionRoute(t, 0, func(conn net.Conn) {
+		conn.Write([]byte("bye"))
+		conn.Close()
+	})
+	conn = connect(t, local)
+
+	// Sessions are half closed, so the client sees the end of the upstream before hanging up itself
+	received, _ := ioutil.ReadAll(conn)
+	assert.Equal(t, "bye", string(received))
+	conn.Close()
+
+	event = waitClosed(t, closed)
+	assert.Equal(t, ReasonUpstreamClose, event.Reason)
+	assert.Equal(t, int64(3), event.Sent)
+	close(kill)
+
+	// Nothing moves for longer than the idle timeout
+	local, kill, closed = sessionRoute(t, 50 * time.Millisecond, hold)
+	conn = connect(t, local)
+
+	assert.Equal(t, ReasonIdleTimeout, waitClosed(t, closed).Reason)
+	conn.Close()
+	close(kill)
+
+	// The route is killed under the session
+	local, kill, closed = sessionRoute(t, 0, hold)
+	conn = connect(t, local)
+	defer conn.Close()
+	time.Sleep(50 * time.Millisecond)
+	close(kill)
+
+	assert.Equal(t, ReasonKilled, waitClosed(t, closed).Reason)
+}
+
+// echoUpstream serves an echo server until the test ends, returning its port.
+func echoUpstream(t *testing.T) string {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				buffer := make([]byte, 64)
+				for {
+					n, err := conn.Read(buffer)
+					if err != nil {
+						conn.Close()
+						return
+					}
+					conn.Write(buffer[:n])
+				}
+			}()
+		}
+	}()
+
+	t.Cleanup(func() {
+		upstream.Close()
+	})
+
+	_, port, _ := net.SplitHostPort(upstream.Addr().String())
+
+	return port
+}
+
+// freePort returns a port nothing listens on, for a route to listen on.
+func freePort() string {
+	free, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer free.Close()
+
+	_, port, _ := net.SplitHostPort(free.Addr().String())
+
+	return port
+}
+
+func echo(t *testing.T, conn net.Conn, message string) {
+	t.Helper()
+
+	conn.SetDeadline(time.Now().Add(time.Second))
+	_, err := conn.Write([]byte(message))
+	assert.Nil(t, err)
+
+	buffer := make([]byte, len(message))
+	_, err = conn.Read(buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, message, string(buffer))
+}
+
+func TestRetargetEndsSessions(t *testing.T) {
+	previousPort := echoUpstream(t)
+	currentPort := echoUpstream(t)
+	localPort := freePort()
+
+	config := backends.ConnectionConfig{
+		Name: "primary",
+		LocalAddress: ":" + localPort,
+		RemoteAddress: "127.0.0.1:" + previousPort,
+		Url: localPort + ":sessions:primary",
+		EndSessionsOnRetarget: true,
+	}
+
+	backend := &flakyBackend{}
+	proxy := CreateProxy(backend)
+	proxy.Logger = slog.New(slog.DiscardHandler)
+
+	closed := make(chan Event, 1)
+	proxy.Subscribe(func(event Event) {
+		if event.Type == SessionClosed {
+			closed <- event
+		}
+	})
+
+	stopped := make(chan struct{})
+	go RunTcpProxy(proxy.Logger, proxy.CreateChannel, proxy.KillChannel, func() {
+		<-stopped
+	})
+	defer close(stopped)
+
+	assert.Nil(t, proxy.applyConnections([]backends.ConnectionConfig{config}))
+
+	conn := connect(t, "127.0.0.1:" + localPort)
+	defer conn.Close()
+	echo(t, conn, "hello")
+
+	// A failover moves the primary without changing the url
+	config.RemoteAddress = "127.0.0.1:" + currentPort
+	assert.Nil(t, proxy.applyConnections([]backends.ConnectionConfig{config}))
+
+	event := waitClosed(t, closed)
+	assert.Equal(t, ReasonRetargeted, event.Reason)
+	assert.Equal(t, "127.0.0.1:" + previousPort, event.Target)
+
+	reconnected := connect(t, "127.0.0.1:" + localPort)
+	defer reconnected.Close()
+	echo(t, reconnected, "hello")
+}
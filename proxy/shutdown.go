@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// How often Shutdown checks whether the sessions have drained
+var drainInterval = 100 * time.Millisecond
+
+var errShuttingDown = fmt.Errorf("The proxy is shutting down")
+
+// Shutdown reports unhealthy for the ShutdownDelay, then stops polling and accepting clients and waits for
+// the sessions to end. The delay is part of ctx, sessions still running once it is done are closed and its
+// error is returned.
+func (c *Proxy) Shutdown(ctx context.Context) error {
+	c.stateLock.Lock()
+	c.draining = true
+	c.stateLock.Unlock()
+
+	c.Logger.Info("Shutting down", "delay", c.ShutdownDelay)
+
+	// Clients keep being accepted until the load balancers have seen the status turn unhealthy
+	if c.ShutdownDelay > 0 {
+		delay := time.NewTimer(c.ShutdownDelay)
+
+		select {
+		case <-delay.C:
+		case <-ctx.Done():
+			delay.Stop()
+		}
+	}
+
+	return c.Drain(ctx)
+}
+
+// Drain stops polling and accepting clients and waits for the sessions like Shutdown, but leaves
+// the status endpoint healthy, as after an upgrade the new process serves on the same sockets.
+func (c *Proxy) Drain(ctx context.Context) error {
+	// Stopped first, so no update creates listeners while the others are closed
+	c.stopPolling()
+
+	c.updateLock.Lock()
+	live := c.connections()
+	routes := make([]*route, 0, len(live))
+
+	for _, connection := range live {
+		if connection.route != nil {
+			routes = append(routes, connection.route)
+		}
+	}
+
+	c.updateLock.Unlock()
+
+	for _, r := range routes {
+		r.closeListener()
+	}
+
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+
+	for {
+		remaining := 0
+
+		for _, r := range routes {
+			remaining += r.sessionCount()
+		}
+
+		if remaining == 0 {
+			c.Logger.Info("Sessions drained")
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			c.Logger.Warn("Closing the sessions left after the shutdown timeout", "sessions", remaining)
+
+			for _, r := range routes {
+				r.terminateSessions(ReasonDrain)
+			}
+
+			return ctx.Err()
+		case <-ticker.C:
+			c.Logger.Debug("Waiting for sessions to drain", "sessions", remaining)
+		}
+	}
+}
+
+// Draining reports whether the proxy is shutting down, which the status endpoint reports as unhealthy.
+func (c *Proxy) Draining() bool {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+
+	return c.draining
+}
+
+// Stopping is closed once the proxy stops polling, when it shuts down or Run returns.
+func (c *Proxy) Stopping() <-chan struct{} {
+	return c.quit
+}
+
+func (c *Proxy) stopPolling() {
+	c.stopOnce.Do(func() {
+		close(c.quit)
+	})
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+// shutdownProxy runs a proxy with a single route to an echo server, returning the local address of the route.
+func shutdownProxy(t *testing.T) (*Proxy, string, chan Event) {
+	upstreamPort := echoUpstream(t)
+	localPort := freePort()
+	local := "127.0.0.1:" + localPort
+
+	proxy := CreateProxy(&flakyBackend{connections: localPort + ":127.0.0.1:" + upstreamPort})
+	proxy.Logger = slog.New(slog.DiscardHandler)
+
+	closed := make(chan Event, 1)
+	proxy.Subscribe(func(event Event) {
+		if event.Type == SessionClosed {
+			closed <- event
+		}
+	})
+
+	stopped := make(chan struct{})
+	go RunTcpProxy(proxy.Logger, proxy.CreateChannel, proxy.KillChannel, func() {
+		<-stopped
+	})
+
+	assert.Nil(t, proxy.UpdateConnections())
+
+	t.Cleanup(func() {
+		close(stopped)
+	})
+
+	return proxy, local, closed
+}
+
+func TestShutdownDrainsSessions(t *testing.T) {
+	proxy, local, closed := shutdownProxy(t)
+
+	conn := connect(t, local)
+	echo(t, conn, "hello")
+
+	done := make(chan error)
+	go func() {
+		done <- proxy.Shutdown(context.Background())
+	}()
+
+	// New clients are refused, the session carries on until it ends by itself
+	assert.Eventually(t, func() bool {
+		refused, err := net.Dial("tcp", local)
+		if err == nil {
+			refused.Close()
+		}
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+
+	assert.True(t, proxy.Draining())
+	echo(t, conn, "still there")
+
+	select {
+	case <-done:
+		t.Fatal("Shut down before the session ended")
+	default:
+	}
+
+	conn.Close()
+
+	assert.Equal(t, ReasonClientClose, waitClosed(t, closed).Reason)
+	assert.Nil(t, <-done)
+
+	// Polling has stopped, so nothing listens again
+	assert.Equal(t, errShuttingDown, proxy.UpdateConnections())
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	proxy, local, closed := shutdownProxy(t)
+
+	conn := connect(t, local)
+	defer conn.Close()
+	echo(t, conn, "hello")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200 * time.Millisecond)
+	defer cancel()
+
+	assert.Equal(t, context.DeadlineExceeded, proxy.Shutdown(ctx))
+	assert.Equal(t, ReasonDrain, waitClosed(t, closed).Reason)
+}
+
+func TestShutdownDelayWithinTimeout(t *testing.T) {
+	proxy, local, closed := shutdownProxy(t)
+	proxy.ShutdownDelay = time.Minute
+
+	conn := connect(t, local)
+	defer conn.Close()
+	echo(t, conn, "hello")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200 * time.Millisecond)
+	defer cancel()
+
+	// The delay doesn't outlast the timeout, which then closes the sessions
+	started := time.Now()
+	assert.Equal(t, context.DeadlineExceeded, proxy.Shutdown(ctx))
+	assert.Less(t, time.Since(started), 5 * time.Second)
+	assert.Equal(t, ReasonDrain, waitClosed(t, closed).Reason)
+}
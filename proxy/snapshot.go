@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+	"github.com/brandnetworks/tcpproxy/backends"
+)
+
+// The first retry of the backend when running from a snapshot, doubling up to a minute
+var snapshotRetryDelay = 5 * time.Second
+
+type snapshot struct {
+	Time        time.Time                   `json:"time"`
+	Connections []backends.ConnectionConfig `json:"connections"`
+}
+
+// saveSnapshot writes to a temporary file first, so a crash never leaves a half written snapshot behind.
+func saveSnapshot(path string, connections []backends.ConnectionConfig) error {
+	out, err := json.Marshal(snapshot{Time: time.Now().UTC(), Connections: connections})
+
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path) + ".tmp")
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(out); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+func loadSnapshot(path string) (*snapshot, error) {
+	in, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var saved snapshot
+
+	if err := json.Unmarshal(in, &saved); err != nil {
+		return nil, err
+	}
+
+	return &saved, nil
+}
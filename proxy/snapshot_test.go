@@ -0,0 +1,279 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+	"github.com/brandnetworks/tcpproxy/backends"
+	"github.com/stretchr/testify/assert"
+)
+
+type flakyBackend struct {
+	sync.Mutex
+	connections string
+	err         error
+}
+
+func (b *flakyBackend) GetProxyConfigurations() ([]backends.ConnectionConfig, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	if b.connections == "" {
+		return []backends.ConnectionConfig{}, nil
+	}
+
+	return backends.ParseConnectionsParameter(b.connections)
+}
+
+func (b *flakyBackend) IsPollable() bool {
+	return false
+}
+
+func (b *flakyBackend) recover() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.err = nil
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "snapshot.json")
+	connections, _ := backends.ParseConnectionsParameter("8002:example.com:5432")
+
+	assert.Nil(t, saveSnapshot(path, connections))
+
+	saved, err := loadSnapshot(path)
+
+	assert.Nil(t, err)
+	assert.Equal(t, connections, saved.Connections)
+	assert.WithinDuration(t, time.Now(), saved.Time, time.Minute)
+
+	// Only the snapshot is left behind, not the temporary file it was written to
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 1)
+}
+
+func TestRunFromSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "snapshot.json")
+	connections, _ := backends.ParseConnectionsParameter("8002:example.com:5432")
+	assert.Nil(t, saveSnapshot(path, connections))
+
+	previousDelay := snapshotRetryDelay
+	snapshotRetryDelay = 10 * time.Millisecond
+	t.Cleanup(func() { snapshotRetryDelay = previousDelay })
+
+	backend := &flakyBackend{connections: "8003:example.com:5433", err: fmt.Errorf("AccessDeniedException")}
+	proxy := CreateProxy(backend)
+	proxy.SnapshotPath = path
+
+	// Nothing listens in this test, so the channels are drained here
+	go func() {
+		for {
+			select {
+			case <-proxy.CreateChannel:
+			case <-proxy.KillChannel:
+			}
+		}
+	}()
+
+	err = proxy.Run(func() {
+		stale, since := proxy.Stale()
+
+		assert.True(t, stale)
+		assert.False(t, since.IsZero())
+
+		_, ok := proxy.connections()["8002:example.com:5432"]
+		assert.True(t, ok)
+
+		backend.recover()
+
+		for i := 0; i < 100; i++ {
+			if stale, _ := proxy.Stale(); !stale {
+				break
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		stale, _ = proxy.Stale()
+		assert.False(t, stale)
+
+		_, ok = proxy.connections()["8003:example.com:5433"]
+		assert.True(t, ok)
+	})
+
+	assert.Nil(t, err)
+
+	// Without a snapshot the failure is returned as before
+	missing := CreateProxy(&flakyBackend{err: fmt.Errorf("AccessDeniedException")})
+	missing.SnapshotPath = filepath.Join(dir, "missing.json")
+
+	assert.NotNil(t, missing.Run(func() {}))
+}
+
+func TestSnapshotOnlySavedOnChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "snapshot.json")
+
+	backend := &flakyBackend{connections: "8002:example.com:5432"}
+	proxy := CreateProxy(backend)
+	proxy.SnapshotPath = path
+
+	quit := make(chan struct{})
+	defer close(quit)
+
+	go func() {
+		for {
+			select {
+			case <-proxy.CreateChannel:
+			case <-proxy.KillChannel:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	assert.Nil(t, proxy.UpdateConnections())
+	_, err = os.Stat(path)
+	assert.Nil(t, err)
+
+	// Nothing changed, so the removed snapshot isn't written again
+	assert.Nil(t, os.Remove(path))
+	assert.Nil(t, proxy.UpdateConnections())
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	backend.Lock()
+	backend.connections = "8002:example.com:5432,8003:example.com:5433"
+	backend.Unlock()
+
+	assert.Nil(t, proxy.UpdateConnections())
+
+	saved, err := loadSnapshot(path)
+	assert.Nil(t, err)
+	assert.Len(t, saved.Connections, 2)
+}
+
+func TestStaleBackend(t *testing.T) {
+	backend := &flakyBackend{connections: "8002:example.com:5432"}
+	proxy := CreateProxy(backend)
+
+	quit := make(chan struct{})
+	defer close(quit)
+
+	go func() {
+		for {
+			select {
+			case <-proxy.CreateChannel:
+			case <-proxy.KillChannel:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	failed := make(chan Event, 1)
+	proxy.Subscribe(func(event Event) {
+		if event.Type == PollFailed {
+			failed <- event
+		}
+	})
+
+	assert.Nil(t, proxy.UpdateConnections())
+
+	// Every source failing is a failed poll, leaving the routes as they are but stale
+	since := time.Now().Add(-time.Minute).UTC()
+	connections, _ := backends.ParseConnectionsParameter("8002:example.com:5432")
+
+	backend.Lock()
+	backend.err = &backends.StaleError{Err: fmt.Errorf("All 2 sources failed"), Connections: connections, Since: since}
+	backend.Unlock()
+
+	assert.NotNil(t, proxy.UpdateConnections())
+	assert.Equal(t, "All 2 sources failed", (<-failed).Error)
+
+	stale, staleSince := proxy.Stale()
+	assert.True(t, stale)
+	assert.Equal(t, since, staleSince)
+
+	_, ok := proxy.connections()["8002:example.com:5432"]
+	assert.True(t, ok)
+
+	backend.recover()
+
+	assert.Nil(t, proxy.UpdateConnections())
+	stale, _ = proxy.Stale()
+	assert.False(t, stale)
+}
+
+func TestRunFromSnapshotUntilHeldApplied(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "snapshot.json")
+	connections, _ := backends.ParseConnectionsParameter("8002:example.com:5432,8003:example.com:5433")
+	assert.Nil(t, saveSnapshot(path, connections))
+
+	previousDelay := snapshotRetryDelay
+	snapshotRetryDelay = 10 * time.Millisecond
+	t.Cleanup(func() { snapshotRetryDelay = previousDelay })
+
+	backend := &flakyBackend{err: fmt.Errorf("AccessDeniedException")}
+	proxy := CreateProxy(backend)
+	proxy.SnapshotPath = path
+	proxy.Guard = DeletionGuard{Polls: 2, Interval: time.Nanosecond}
+
+	quit := make(chan struct{})
+	defer close(quit)
+
+	go func() {
+		for {
+			select {
+			case <-proxy.CreateChannel:
+			case <-proxy.KillChannel:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	err = proxy.Run(func() {
+		// The backend answers with no routes at all, held until the retries confirm it
+		backend.recover()
+
+		for i := 0; i < 100; i++ {
+			if stale, _ := proxy.Stale(); !stale {
+				break
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		stale, _ := proxy.Stale()
+		assert.False(t, stale)
+		assert.Empty(t, proxy.connections())
+		assert.Nil(t, proxy.Held())
+	})
+
+	assert.Nil(t, err)
+}
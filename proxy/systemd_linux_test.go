@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"github.com/brandnetworks/tcpproxy/backends"
+	"github.com/stretchr/testify/assert"
+)
+
+type configBackend []backends.ConnectionConfig
+
+func (b configBackend) GetProxyConfigurations() ([]backends.ConnectionConfig, error) {
+	return b, nil
+}
+
+func (b configBackend) IsPollable() bool {
+	return false
+}
+
+// activate passes the sockets of files to InheritListeners as systemd would, from fd 100 onwards.
+func activate(t *testing.T, names string, files ...*os.File) {
+	previous := listenFdsStart
+	listenFdsStart = 100
+	t.Cleanup(func() { listenFdsStart = previous })
+
+	for i, file := range files {
+		assert.Nil(t, syscall.Dup3(int(file.Fd()), listenFdsStart + i, 0))
+		file.Close()
+	}
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", strconv.Itoa(len(files)))
+	t.Setenv("LISTEN_FDNAMES", names)
+
+	assert.Nil(t, InheritListeners(slog.New(slog.DiscardHandler)))
+}
+
+func listenerFile(t *testing.T) (string, *os.File) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	file, err := listener.(*net.TCPListener).File()
+	assert.Nil(t, err)
+
+	return listener.Addr().String(), file
+}
+
+func TestSocketActivation(t *testing.T) {
+	named, namedFile := listenerFile(t)
+	unnamed, unnamedFile := listenerFile(t)
+
+	packet, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	packetFile, err := packet.(*net.UDPConn).File()
+	assert.Nil(t, err)
+	packet.Close()
+
+	activate(t, "postgres:tcpproxy.socket:metrics", namedFile, unnamedFile, packetFile)
+
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer upstream.Close()
+
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("activated"))
+			conn.Close()
+		}
+	}()
+
+	// Routes are matched by address only, the name of a route is its destination host rather than a socket
+	proxy := CreateProxy(configBackend{
+		{Name: "postgres", LocalAddress: unnamed, RemoteAddress: upstream.Addr().String(), Url: "1:postgres"},
+		{Name: "postgres", LocalAddress: named, RemoteAddress: upstream.Addr().String(), Url: "2:postgres"},
+	})
+	proxy.Logger = slog.New(slog.DiscardHandler)
+
+	err = proxy.Run(func() {
+		RunTcpProxy(proxy.Logger, proxy.CreateChannel, proxy.KillChannel, func() {
+			for _, address := range []string{named, unnamed} {
+				conn := connect(t, address)
+				received, _ := ioutil.ReadAll(conn)
+				conn.Close()
+
+				assert.Equal(t, "activated", string(received), address)
+			}
+
+			proxy.Shutdown(context.Background())
+		})
+	})
+
+	assert.Nil(t, err)
+}
+
+func TestSocketActivationForAnotherProcess(t *testing.T) {
+	address, file := listenerFile(t)
+	defer file.Close()
+
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_FDNAMES", "")
+
+	assert.Nil(t, InheritListeners(slog.New(slog.DiscardHandler)))
+
+	_, ok := inherited.take(address)
+	assert.False(t, ok)
+}
+
+func TestSameAddress(t *testing.T) {
+	wildcard := &net.TCPAddr{IP: net.IPv6unspecified, Port: 5432}
+	loopback := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5432}
+
+	assert.True(t, sameAddress(":5432", wildcard))
+	assert.True(t, sameAddress("0.0.0.0:5432", wildcard))
+	assert.True(t, sameAddress("[::]:5432", wildcard))
+	assert.False(t, sameAddress(":5433", wildcard))
+	assert.False(t, sameAddress(":5432", loopback))
+	assert.True(t, sameAddress("127.0.0.1:5432", loopback))
+	assert.False(t, sameAddress("10.0.0.1:5432", loopback))
+	assert.False(t, sameAddress("localhost:5432", loopback))
+}
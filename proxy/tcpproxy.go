@@ -1,150 +1,381 @@
 package proxy
 import (
-	"log"
+	"context"
+	"log/slog"
 	"sync"
 	"net"
 	"time"
 	"io"
-	"fmt"
 	"github.com/brandnetworks/tcpproxy/backends"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Connection struct {
 	config  backends.ConnectionConfig
 	channel chan bool
+	route   *route
 }
 
 func CreateConnection(configuration backends.ConnectionConfig) Connection {
+	r, err := newRoute(configuration)
+
+	if err != nil {
+		slog.Warn("Invalid connection configuration", "route", configuration.Url, "error", err)
+
+		// Keep the connection, but refuse every client until it gets a valid configuration
+		r = &route{config: configuration, err: err}
+	}
+
 	return Connection{
 		config:  configuration,
 		channel: make(chan bool),
+		route:   r,
 	}
 }
 
-func Listen(logLevel int, localAddr string, remoteAddr string, kill chan bool) error {
-	local, err := net.Listen("tcp", localAddr)
+func Listen(logger *slog.Logger, localAddr string, remoteAddr string, kill chan bool) error {
+	return listenRoute(logger, &route{config: backends.ConnectionConfig{LocalAddress: localAddr, RemoteAddress: remoteAddr}}, kill)
+}
+
+func listenRoute(logger *slog.Logger, r *route, kill chan bool) error {
+	config := r.current()
+	logger = logger.With("route", config.Url, "local", config.LocalAddress)
+	local, err := r.listen()
 
 	if err != nil {
-		log.Fatal("Error atempting to establish connection", err)
+		logger.Error("Error atempting to establish connection", "error", err)
+		r.failListen(err)
+		r.events.Publish(Event{Type: ListenFailed, Route: config.Url, Local: config.LocalAddress, Error: errorString(err)})
 		return err
 	}
 
 	defer local.Close()
 
-	for {
-		select {
+	if !r.setListener(local) {
+		logger.Debug("Not accepting clients, the proxy is shutting down")
+		return nil
+	}
 
-		case die, ok := <-kill:
-			if !ok || die {
+	killed := make(chan struct{})
+
+	// Accept blocks, so the listener is closed to stop it once the connection is killed
+	go func() {
+		for die := range kill {
+			if die {
 				break
 			}
+		}
 
-		default:
-			conn, err := local.Accept()
+		close(killed)
+		local.Close()
+
+		// The route is gone, so are the sessions using it
+		r.terminateSessions(ReasonKilled)
+	}()
 
-			if err != nil {
-				return err
+	for {
+		conn, err := local.Accept()
+
+		if err != nil {
+			select {
+			case <-killed:
+				return nil
+			default:
 			}
 
-			go forward(logLevel, conn, remoteAddr)
+			if r.isClosing() {
+				logger.Info("No longer accepting clients")
+				return nil
+			}
+
+			return err
 		}
-	}
 
-	return nil
+		if !r.allows(conn.RemoteAddr()) {
+			logger.Warn("Rejected client", "client", conn.RemoteAddr().String())
+			conn.Close()
+			continue
+		}
+
+		go forward(logger, conn, r)
+	}
 }
 
-func forward(logLevel int, local net.Conn, remoteAddr string) error {
-	if logLevel > 0 {
-		log.Printf("Connecting to on %s", remoteAddr)
+// listen takes over the inherited listener of the route, or listens on its local address.
+func (r *route) listen() (net.Listener, error) {
+	r.Lock()
+	listener := r.inherited
+	r.inherited = nil
+	r.Unlock()
+
+	if listener != nil {
+		return listener, nil
 	}
-	remote, err := net.DialTimeout("tcp", remoteAddr, 1*time.Minute)
+
+	return ListenTCP(r.current().LocalAddress)
+}
+
+func forward(logger *slog.Logger, local net.Conn, r *route) error {
+	s := newSession(local)
+	logger = logger.With("session", s.id, "client", s.client)
+
+	r.addSession(s)
+	defer r.removeSession(s)
+
+	config := r.current()
+
+	// Each session starts its own trace, covering the lookup, the dial and the copying
+	ctx, span := tracer().Start(context.Background(), "session", trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		attribute.String("tcpproxy.route", config.Url),
+		attribute.String("tcpproxy.local", config.LocalAddress),
+		attribute.String("tcpproxy.session", s.id),
+		attribute.String("client.address", s.client),
+	))
+	defer span.End()
+
+	remote, err := r.dial(ctx, logger)
 	if err != nil {
+		logger.Warn("Error connecting to every upstream", "error", err)
 		local.Close()
+
+		span.SetAttributes(attribute.String("tcpproxy.reason", ReasonDialFailed))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+
+		r.events.Publish(Event{
+			Type:     SessionClosed,
+			Time:     time.Now().UTC(),
+			Route:    config.Url,
+			Local:    config.LocalAddress,
+			Session:  s.id,
+			Client:   s.client,
+			Duration: time.Since(s.started),
+			Reason:   ReasonDialFailed,
+			Error:    errorString(err),
+		})
+
 		return err
 	}
 
-	proxyTCP(logLevel, local.(*net.TCPConn), remote.(*net.TCPConn))
+	s.connected(remote)
+	logger = logger.With("upstream", s.upstream)
+
+	logger.Debug("Session opened")
+	r.events.Publish(Event{Type: SessionOpened, Route: config.Url, Local: config.LocalAddress, Session: s.id, Client: s.client, Target: s.upstream})
+
+	if idleTimeout := config.IdleTimeout; idleTimeout > 0 {
+		local = &idleTimeoutConn{Conn: local, timeout: idleTimeout}
+		remote = &idleTimeoutConn{Conn: remote, timeout: idleTimeout}
+	}
+
+	span.SetAttributes(attribute.String("tcpproxy.upstream", s.upstream))
+
+	_, copySpan := tracer().Start(ctx, "copy")
+	sent, received := proxyTCP(logger, s, local, remote)
+	copySpan.End()
+
+	duration := time.Since(s.started)
+	reason := s.endReason()
+
+	span.SetAttributes(
+		attribute.Int64("tcpproxy.bytes_sent", sent),
+		attribute.Int64("tcpproxy.bytes_received", received),
+		attribute.String("tcpproxy.reason", reason),
+	)
+
+	logger.Debug("Session closed", "bytes_sent", sent, "bytes_received", received, "duration", duration, "reason", reason)
+
+	r.events.Publish(Event{
+		Type:     SessionClosed,
+		Time:     time.Now().UTC(),
+		Route:    config.Url,
+		Local:    config.LocalAddress,
+		Session:  s.id,
+		Client:   s.client,
+		Target:   s.upstream,
+		Sent:     sent,
+		Received: received,
+		Duration: duration,
+		Reason:   reason,
+	})
+
 	return nil
 }
 
-// proxyTCP proxies data bi-directionally between in and out.
-func proxyTCP(logLevel int, in, out *net.TCPConn) {
+// proxyTCP proxies data bi-directionally between in and out, returning the bytes copied to and from in.
+func proxyTCP(logger *slog.Logger, s *session, in, out net.Conn) (int64, int64) {
 	var wg sync.WaitGroup
+	var sent, received int64
 	wg.Add(2)
 
-	if logLevel > 0 {
-		log.Printf("Creating proxy between %v <-> %v <-> %v <-> %v",
-			in.RemoteAddr(), in.LocalAddr(), out.LocalAddr(), out.RemoteAddr())
-	}
-
-	go copyBytes(logLevel, "from backend", in, out, &wg)
-	go copyBytes(logLevel, "to backend", out, in, &wg)
+	go copyBytes(logger, s, "from backend", in, out, &wg, &sent)
+	go copyBytes(logger, s, "to backend", out, in, &wg, &received)
 	wg.Wait()
 	in.Close()
 	out.Close()
+
+	return sent, received
 }
 
-func copyBytes(logLevel int, direction string, dest, src *net.TCPConn, wg *sync.WaitGroup) {
+func copyBytes(logger *slog.Logger, s *session, direction string, dest, src net.Conn, wg *sync.WaitGroup, copied *int64) {
 	defer wg.Done()
-	if logLevel > 0 {
-		log.Printf("Copying %s: %s -> %s", direction, src.RemoteAddr(), dest.RemoteAddr())
-	}
 	n, err := io.Copy(dest, src)
+	*copied = n
+
+	// Whichever side stops first ends the session
+	s.end(copyReason(err, direction == "to backend"))
+
 	if err != nil {
-		log.Printf("I/O error: %v", err)
+		logger.Debug("Copy interrupted", "direction", direction, "error", err)
+
+		// An idle session has timed out in both directions, not just this one
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			dest.Close()
+			src.Close()
+		}
+	}
+	closeWrite(dest)
+	closeRead(src)
+}
+
+// idleTimeoutConn pushes the deadline back on every read or write, so a
+// session only times out once no data has moved in either direction.
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleTimeoutConn) Read(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+func (c *idleTimeoutConn) Write(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
+
+func closeWrite(conn net.Conn) {
+	if wrapped, ok := conn.(*idleTimeoutConn); ok {
+		conn = wrapped.Conn
+	}
+
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
 	}
-	if logLevel > 0 {
-		log.Printf("Copied %d bytes %s: %s -> %s", n, direction, src.RemoteAddr(), dest.RemoteAddr())
+}
+
+func closeRead(conn net.Conn) {
+	if wrapped, ok := conn.(*idleTimeoutConn); ok {
+		conn = wrapped.Conn
+	}
+
+	if c, ok := conn.(interface{ CloseRead() error }); ok {
+		c.CloseRead()
 	}
-	dest.CloseWrite()
-	src.CloseRead()
 }
 
-func RunTcpProxy(logLevel int, createChannel chan []Connection, killChannel chan []Connection, cb func()) {
+func RunTcpProxy(logger *slog.Logger, createChannel chan []Connection, killChannel chan []Connection, cb func()) {
 
 	quit := make(chan struct{})
+	done := make(chan struct{})
 
 	go func() {
-		for {
+		serveRoutes(logger, createChannel, killChannel, quit)
+		close(done)
+	}()
+
+	cb()
+
+	close(quit)
+	<-done
+}
+
+// serveRoutes listens on the connections created by the proxy and stops listening on the killed ones. It owns
+// the goroutines listening, so once quit is closed it kills the routes still listening and waits for them.
+func serveRoutes(logger *slog.Logger, createChannel chan []Connection, killChannel chan []Connection, quit <-chan struct{}) {
+
+	// Closed once the listener of the route with that kill channel has returned
+	owned := make(map[chan bool]chan struct{})
+
+	// Routes killed before their creation was read, which can happen as the channels are read in any order.
+	// An update only kills routes whose creation was sent before, so it is in the next creations read
+	killed := make(map[chan bool]bool)
 
+	defer func() {
+		for kill, listening := range owned {
+			close(kill)
+			<-listening
+		}
+	}()
+
+	kill := func(toKill []Connection) {
+		for i := range toKill {
+			close(toKill[i].channel)
+
+			// Waited for, so a route the same update creates on the same port can listen on it
+			if listening, ok := owned[toKill[i].channel]; ok {
+				<-listening
+				delete(owned, toKill[i].channel)
+			} else {
+				killed[toKill[i].channel] = true
+			}
+
+			logger.Info("No longer listening", "route", toKill[i].config.Url, "local", toKill[i].config.LocalAddress)
+		}
+	}
+
+	for {
+
+		select {
+		case toKill, ok := <-killChannel:
+			if ok {
+				kill(toKill)
+			} else {
+				logger.Error("Failed to read from the kill channel")
+				panic("Couldnt read from toKill in RunTcpProxy")
+			}
+
+		case toCreate, ok := <-createChannel:
+			if !ok {
+				logger.Error("Failed to read from the create channel")
+				panic("Couldnt read from toCreate in RunTcpProxy")
+			}
+
+			// An update sends its kills first, they free the ports its creations may listen on
 			select {
 			case toKill, ok := <-killChannel:
 				if ok {
-					// Kill those connections
-					for i := range toKill {
-						close(toKill[i].channel)
-
-						if logLevel > 0 {
-							log.Printf("No longer listening on %s", toKill[i])
-						}
-					}
-				} else {
-					fmt.Errorf("Failed to read from kill channel.")
-					panic("Couldnt read from toKill in RunTcpProxy")
+					kill(toKill)
 				}
+			default:
+			}
 
-			case toCreate, ok := <-createChannel:
-				if ok {
-					// Create those connections
-					for i := range toCreate {
-						go Listen(logLevel, toCreate[i].config.LocalAddress, toCreate[i].config.RemoteAddress, toCreate[i].channel)
-
-						if logLevel > 0 {
-							log.Printf("Listening on %s", toCreate[i].config.LocalAddress)
-						}
-					}
-				} else {
-					fmt.Errorf("Failed to read from create channel.")
-					panic("Couldnt read from toCreate in RunTcpProxy")
+			// Create those connections
+			for i := range toCreate {
+				if killed[toCreate[i].channel] {
+					delete(killed, toCreate[i].channel)
+					continue
 				}
 
-			case <-quit:
-				return
+				listening := make(chan struct{})
+				owned[toCreate[i].channel] = listening
+
+				go func(connection Connection) {
+					defer close(listening)
+					listenRoute(logger, connection.route, connection.channel)
+				}(toCreate[i])
+
+				logger.Info("Listening", "route", toCreate[i].config.Url, "local", toCreate[i].config.LocalAddress)
 			}
-		}
-	}()
 
-	cb()
+			// The rest were never created, like the invalid routes an update leaves out
+			clear(killed)
 
-	quit <- struct{}{}
-}
\ No newline at end of file
+		case <-quit:
+			return
+		}
+	}
+}
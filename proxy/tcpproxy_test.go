@@ -1,9 +1,11 @@
 package proxy
 
 import (
+	"log/slog"
 	"net"
 	"fmt"
 	"testing"
+	"time"
 	"github.com/stretchr/testify/assert"
 	"github.com/brandnetworks/tcpproxy/backends"
 )
@@ -28,13 +30,14 @@ func echoServer(t *testing.T, quit chan bool) {
 
 	l, err := net.Listen("tcp", ":11111")
 	if err != nil {
-		t.Fatal(err)
+		t.Error(err)
+		return
 	}
 	defer l.Close()
 	go func() {
 		c, err := l.Accept()
 		if err != nil {
-			t.Fatal(err)
+			return
 		}
 		fmt.Fprintln(c, "OK")
 		c.Close()
@@ -54,18 +57,15 @@ func TestListen(t *testing.T) {
 	quit := make(chan bool)
 
 	go echoServer(t, quit)
-	go Listen(1, ":11110", "localhost:11111", quit)
+	go Listen(slog.Default(), ":11110", "localhost:11111", quit)
 
-	conn, err := net.Dial("tcp", "localhost:11110")
-	if err != nil {
-		t.Fatal(err)
-	}
+	conn := connect(t, "localhost:11110")
 
 	var cmd []byte
 	fmt.Fscan(conn, &cmd)
 	t.Log("Message:", string(cmd))
 
-	quit <- true
+	close(quit)
 }
 
 func TestRunProxy(t *testing.T) {
@@ -87,13 +87,10 @@ func TestRunProxy(t *testing.T) {
 		connections[i] = CreateConnection(connectionsConfig[i])
 	}
 
-	go RunTcpProxy(1, create, kill, func() {
+	RunTcpProxy(slog.Default(), create, kill, func() {
 		create <-connections
 
-		conn, err := net.Dial("tcp", "localhost:11112")
-		if err != nil {
-			t.Fatal(err)
-		}
+		conn := connect(t, "localhost:11112")
 		defer conn.Close()
 
 		var cmd []byte
@@ -104,3 +101,16 @@ func TestRunProxy(t *testing.T) {
 	})
 
 }
+
+func connect(t *testing.T, address string) net.Conn {
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("tcp", address); err == nil {
+			return conn
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("Not listening on", address)
+	return nil
+}
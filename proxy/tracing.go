@@ -0,0 +1,23 @@
+package proxy
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Spans go to the global tracer provider, which does nothing until one is configured. It is
+// looked up on every span, so the provider configured at startup applies.
+func tracer() trace.Tracer {
+	return otel.Tracer("github.com/brandnetworks/tcpproxy/proxy")
+}
+
+// endSpan ends span, marking it failed when err isn't nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+	"github.com/brandnetworks/tcpproxy/backends"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans records the spans ended from now on.
+func recordSpans() *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+
+	return exporter
+}
+
+func findSpan(exporter *tracetest.InMemoryExporter, name string) (tracetest.SpanStub, bool) {
+	for _, span := range exporter.GetSpans() {
+		if span.Name == name {
+			return span, true
+		}
+	}
+
+	return tracetest.SpanStub{}, false
+}
+
+func spanAttribute(span tracetest.SpanStub, key string) attribute.Value {
+	for _, kv := range span.Attributes {
+		if string(kv.Key) == key {
+			return kv.Value
+		}
+	}
+
+	return attribute.Value{}
+}
+
+// contextBackend makes a call of its own during the poll, as the AWS backends do.
+type contextBackend struct {
+	flakyBackend
+}
+
+func (b *contextBackend) GetProxyConfigurationsWithContext(ctx context.Context) ([]backends.ConnectionConfig, error) {
+	_, span := otel.Tracer("test").Start(ctx, "lookup")
+	defer span.End()
+
+	return b.GetProxyConfigurations()
+}
+
+func TestPollSpans(t *testing.T) {
+	exporter := recordSpans()
+
+	backend := &contextBackend{flakyBackend{connections: "8001:example.com:5431,8002:example.com:5432"}}
+	proxy := CreateProxy(backend)
+	drain(proxy)
+
+	assert.Nil(t, proxy.UpdateConnections())
+
+	poll, ok := findSpan(exporter, "poll")
+	assert.True(t, ok)
+	assert.Equal(t, int64(2), spanAttribute(poll, "tcpproxy.connections").AsInt64())
+	assert.Equal(t, codes.Unset, poll.Status.Code)
+
+	// The calls of the backend belong to the trace of the poll
+	lookup, ok := findSpan(exporter, "lookup")
+	assert.True(t, ok)
+	assert.Equal(t, poll.SpanContext.TraceID(), lookup.SpanContext.TraceID())
+	assert.Equal(t, poll.SpanContext.SpanID(), lookup.Parent.SpanID())
+
+	exporter.Reset()
+	backend.Lock()
+	backend.err = fmt.Errorf("backend down")
+	backend.Unlock()
+
+	assert.NotNil(t, proxy.UpdateConnections())
+
+	poll, ok = findSpan(exporter, "poll")
+	assert.True(t, ok)
+	assert.Equal(t, codes.Error, poll.Status.Code)
+	assert.Equal(t, "backend down", poll.Status.Description)
+}
+
+func TestSessionSpans(t *testing.T) {
+	exporter := recordSpans()
+
+	local, kill, closed := hostRoute(t, "localhost", 0, func(conn net.Conn) {
+		conn.Write([]byte("bye"))
+		conn.Close()
+	})
+	defer close(kill)
+
+	conn := connect(t, local)
+	buffer := make([]byte, 3)
+	conn.Read(buffer)
+	conn.Close()
+	waitClosed(t, closed)
+
+	// The session span ends once the session is closed
+	assert.Eventually(t, func() bool {
+		_, ok := findSpan(exporter, "session")
+		return ok
+	}, time.Second, 10*time.Millisecond)
+
+	session, _ := findSpan(exporter, "session")
+	assert.Equal(t, local, "127.0.0.1" + spanAttribute(session, "tcpproxy.local").AsString())
+	assert.Equal(t, int64(3), spanAttribute(session, "tcpproxy.bytes_sent").AsInt64())
+	assert.Equal(t, ReasonUpstreamClose, spanAttribute(session, "tcpproxy.reason").AsString())
+
+	for _, name := range []string{"dns", "dial", "copy"} {
+		child, ok := findSpan(exporter, name)
+
+		assert.True(t, ok, name)
+		assert.Equal(t, session.SpanContext.TraceID(), child.SpanContext.TraceID(), name)
+	}
+
+	dns, _ := findSpan(exporter, "dns")
+	assert.Equal(t, "localhost", spanAttribute(dns, "server.address").AsString())
+
+	dial, _ := findSpan(exporter, "dial")
+	assert.Equal(t, session.SpanContext.SpanID(), dial.Parent.SpanID())
+	assert.NotEmpty(t, spanAttribute(dial, "network.peer.address").AsString())
+}
+
+func TestDialFailureSpans(t *testing.T) {
+	exporter := recordSpans()
+
+	// Nothing listens on the upstream
+	free, _ := net.Listen("tcp", "127.0.0.1:0")
+	upstream := free.Addr().String()
+	free.Close()
+
+	r, err := newRoute(backends.ConnectionConfig{LocalAddress: ":0", RemoteAddress: upstream, Url: "0:" + upstream})
+	assert.Nil(t, err)
+
+	_, err = r.dial(context.Background(), slog.New(slog.DiscardHandler))
+	assert.NotNil(t, err)
+
+	dial, ok := findSpan(exporter, "dial")
+	assert.True(t, ok)
+	assert.Equal(t, codes.Error, dial.Status.Code)
+
+	// Addresses are dialled as they are
+	_, ok = findSpan(exporter, "dns")
+	assert.False(t, ok)
+}
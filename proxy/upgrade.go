@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The inherited file descriptor the new process reports it is ready on
+const readyEnv = "TCPPROXY_READY_FD"
+
+// How long the new process gets to report it is ready before the upgrade is abandoned
+var upgradeTimeout = 1 * time.Minute
+
+// StartUpgrade starts command, normally the binary and arguments this process was started with, handing it
+// the listeners by the address they listen on. It returns once the new process calls NotifyReady, after which
+// this one should drain. A new process that exits or isn't ready in time is killed, and nothing is handed over.
+func StartUpgrade(logger *slog.Logger, command []string, listeners map[string]net.Listener) (*os.Process, error) {
+	files := make([]*os.File, 0, len(listeners) + 1)
+	mapping := make([]string, 0, len(listeners))
+
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	for address, listener := range listeners {
+		filer, ok := listener.(interface{ File() (*os.File, error) })
+
+		if !ok {
+			return nil, fmt.Errorf("The listener on %s can't be handed over", address)
+		}
+
+		file, err := filer.File()
+
+		if err != nil {
+			return nil, err
+		}
+
+		// The new process sees the extra files from fd 3 onwards
+		mapping = append(mapping, fmt.Sprintf("%d=%s", 3 + len(files), address))
+		files = append(files, file)
+	}
+
+	ready, readyWriter, err := os.Pipe()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer ready.Close()
+
+	readyFd := 3 + len(files)
+	files = append(files, readyWriter)
+
+	path, err := exec.LookPath(command[0])
+
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(path, command[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(environWithout(listenersEnv, readyEnv),
+		listenersEnv + "=" + strings.Join(mapping, ","),
+		readyEnv + "=" + strconv.Itoa(readyFd))
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	logger.Info("Started the new process, waiting for it to be ready", "pid", cmd.Process.Pid, "listeners", len(listeners))
+
+	// Without our copy of the writer, the read ends when the new process exits without reporting
+	readyWriter.Close()
+
+	result := make(chan error, 1)
+
+	go func() {
+		buffer := make([]byte, 1)
+		_, err := ready.Read(buffer)
+		result <- err
+	}()
+
+	select {
+	case err = <-result:
+	case <-time.After(upgradeTimeout):
+		err = fmt.Errorf("Not ready within %v", upgradeTimeout)
+	}
+
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+
+		return nil, fmt.Errorf("The new process failed to start: %v", err)
+	}
+
+	// Reaped while this process drains
+	go cmd.Wait()
+
+	return cmd.Process, nil
+}
+
+// NotifyReady tells the process upgrading to this one that it serves, so that one can drain.
+func NotifyReady() error {
+	value := os.Getenv(readyEnv)
+	os.Unsetenv(readyEnv)
+
+	if value == "" {
+		return nil
+	}
+
+	fd, err := strconv.Atoi(value)
+
+	if err != nil {
+		return fmt.Errorf("Invalid ready file descriptor '%s'", value)
+	}
+
+	file := os.NewFile(uintptr(fd), "ready")
+	defer file.Close()
+
+	_, err = file.Write([]byte{1})
+
+	return err
+}
+
+func environWithout(names ...string) []string {
+	environment := make([]string, 0)
+
+	for _, variable := range os.Environ() {
+		keep := true
+
+		for _, name := range names {
+			if strings.HasPrefix(variable, name + "=") {
+				keep = false
+			}
+		}
+
+		if keep {
+			environment = append(environment, variable)
+		}
+	}
+
+	return environment
+}
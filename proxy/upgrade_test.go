@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+// inherit passes listeners to InheritListeners as the process upgrading to this one would, returning their local addresses.
+func inherit(t *testing.T, count int) []string {
+	addresses := make([]string, count)
+	mapping := ""
+
+	for i := range addresses {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Nil(t, err)
+
+		file, err := listener.(*net.TCPListener).File()
+		assert.Nil(t, err)
+
+		// InheritListeners closes the descriptor it is given, which the file mustn't close again
+		fd, err := syscall.Dup(int(file.Fd()))
+		assert.Nil(t, err)
+		file.Close()
+
+		// Only the inherited copy listens from now on
+		listener.Close()
+
+		_, port, _ := net.SplitHostPort(listener.Addr().String())
+		addresses[i] = ":" + port
+
+		if i > 0 {
+			mapping += ","
+		}
+		mapping += fmt.Sprintf("%d=%s", fd, addresses[i])
+	}
+
+	t.Setenv(listenersEnv, mapping)
+	assert.Nil(t, InheritListeners(slog.New(slog.DiscardHandler)))
+
+	return addresses
+}
+
+func TestInheritListeners(t *testing.T) {
+	addresses := inherit(t, 2)
+
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer upstream.Close()
+
+	go func() {
+		conn, err := upstream.Accept()
+		if err == nil {
+			conn.Write([]byte("inherited"))
+			conn.Close()
+		}
+	}()
+
+	// Only the first address is routed
+	proxy := CreateProxy(&flakyBackend{connections: addresses[0][1:] + ":" + upstream.Addr().String()})
+	proxy.Logger = slog.New(slog.DiscardHandler)
+
+	err = proxy.Run(func() {
+		RunTcpProxy(proxy.Logger, proxy.CreateChannel, proxy.KillChannel, func() {
+			conn := connect(t, "127.0.0.1" + addresses[0])
+			defer conn.Close()
+
+			received, _ := ioutil.ReadAll(conn)
+			assert.Equal(t, "inherited", string(received))
+
+			// The listener no route took over is closed rather than left queueing clients
+			_, err := net.Dial("tcp", "127.0.0.1" + addresses[1])
+			assert.NotNil(t, err)
+		})
+	})
+
+	assert.Nil(t, err)
+}
+
+// TestUpgradeChild is the new process started by TestUpgrade.
+func TestUpgradeChild(t *testing.T) {
+	address := os.Getenv("TCPPROXY_TEST_UPGRADE")
+
+	if address == "" {
+		t.Skip("Only run as the new process of TestUpgrade")
+	}
+
+	// Keeps the output of the new process out of the results of TestUpgrade
+	defer os.Exit(0)
+
+	assert.Nil(t, InheritListeners(slog.New(slog.DiscardHandler)))
+
+	listener, err := ListenTCP(address)
+	assert.Nil(t, err)
+	assert.Nil(t, NotifyReady())
+
+	conn, err := listener.Accept()
+	assert.Nil(t, err)
+
+	conn.Write([]byte("upgraded"))
+	conn.Close()
+}
+
+func TestUpgrade(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	address := listener.Addr().String()
+	t.Setenv("TCPPROXY_TEST_UPGRADE", address)
+
+	process, err := StartUpgrade(slog.New(slog.DiscardHandler), []string{os.Args[0], "-test.run=^TestUpgradeChild$"}, map[string]net.Listener{address: listener})
+	assert.Nil(t, err)
+	assert.NotNil(t, process)
+
+	// Handed over, the new process answers once this one stops accepting
+	listener.Close()
+
+	conn, err := net.DialTimeout("tcp", address, time.Second)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	received, _ := ioutil.ReadAll(conn)
+	assert.Equal(t, "upgraded", string(received))
+}
+
+func TestUpgradeNeverReady(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	// Exits without reporting it is ready
+	_, err = StartUpgrade(slog.New(slog.DiscardHandler), []string{"false"}, map[string]net.Listener{listener.Addr().String(): listener})
+	assert.NotNil(t, err)
+}
+
+func TestWaitListening(t *testing.T) {
+	proxy, local, _ := shutdownProxy(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+
+	// Ready to be reported as soon as it returns, with nothing left binding in the background
+	assert.Nil(t, proxy.WaitListening(ctx))
+
+	conn, err := net.Dial("tcp", local)
+	assert.Nil(t, err)
+	defer conn.Close()
+	echo(t, conn, "hello")
+}
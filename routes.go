@@ -0,0 +1,231 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"github.com/brandnetworks/tcpproxy/backends"
+)
+
+const routesUsage = "Usage: tcpproxy routes list|add|remove|enable|disable [<port>:<url>:<port>] --backend dynamodb --proxy <name>"
+
+// RunRoutesCommand manages the stored configurations of a backend, printing what changed.
+func RunRoutesCommand(arguments []string, out io.Writer) error {
+	if len(arguments) == 0 {
+		return NewTcpProxyError(routesUsage)
+	}
+
+	action := arguments[0]
+
+	args := TcpProxyArgs{}
+	flags := flag.NewFlagSet("routes", flag.ContinueOnError)
+
+	args.logLevel = flags.Int("debug", 0, "Enable debug logging, kept for compatibility with --log-level debug")
+	args.logLevelName = flags.String("log-level", "warn", "The minimum level logged of 'debug', 'info', 'warn' and 'error'")
+	args.logFormat = flags.String("log-format", "logfmt", "The format of the logs, 'logfmt' or 'json'")
+	args.backend = flags.String("backend", "dynamodb", "The backend whose routes are managed, only 'dynamodb' supports it")
+	args.proxyName = flags.String("proxy", "", "This flag sets the name of the proxy")
+
+	RegisterBackendFlags(flags, &args)
+
+	// Flags may come before or after the connection, the flag package stops at the first positional argument
+	positional := make([]string, 0)
+	rest := arguments[1:]
+
+	for {
+		if err := flags.Parse(rest); err != nil {
+			return err
+		}
+
+		if flags.NArg() == 0 {
+			break
+		}
+
+		positional = append(positional, flags.Arg(0))
+		rest = flags.Args()[1:]
+	}
+
+	logger, err := GetLogger(args, os.Stderr)
+
+	if err != nil {
+		return err
+	}
+
+	backend, err := GetBackend(logger, args)
+
+	if err != nil {
+		return err
+	}
+
+	manageable, ok := backend.(backends.Manageable)
+
+	if !ok {
+		return NewTcpProxyError(fmt.Sprintf("Error: the %s backend does not support managing routes.", *args.backend))
+	}
+
+	return ManageRoutes(manageable, action, positional, out)
+}
+
+// ManageRoutes runs action against the stored configurations, only add needs a well formed connection so
+// the others also work on the invalid ones by their raw key.
+func ManageRoutes(manageable backends.Manageable, action string, positional []string, out io.Writer) error {
+	before, err := manageable.ListProxyConfigurations()
+
+	if err != nil {
+		return err
+	}
+
+	if action == "list" {
+		printRoutes(out, before)
+		return nil
+	}
+
+	if len(positional) != 1 {
+		return NewTcpProxyError(routesUsage)
+	}
+
+	configuration := positional[0]
+
+	_, exists := routesByUrl(before)[configuration]
+
+	switch action {
+	case "add":
+		if exists {
+			return NewTcpProxyError(fmt.Sprintf("Error: %s already exists.", configuration))
+		}
+
+		var connection *backends.ConnectionConfig
+
+		if connection, err = backends.ParseConnection(configuration); err != nil {
+			return err
+		}
+
+		if err = connection.Validate(); err != nil {
+			return err
+		}
+
+		err = manageable.CreateProxyConfiguration(configuration)
+
+	case "remove":
+		if !exists {
+			return NewTcpProxyError(fmt.Sprintf("Error: %s does not exist.", configuration))
+		}
+
+		err = manageable.DeleteProxyConfiguration(configuration)
+
+	case "enable", "disable":
+		if !exists {
+			return NewTcpProxyError(fmt.Sprintf("Error: %s does not exist.", configuration))
+		}
+
+		err = manageable.SetProxyConfigurationEnabled(configuration, action == "enable")
+
+	default:
+		return NewTcpProxyError(routesUsage)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	after, err := manageable.ListProxyConfigurations()
+
+	if err != nil {
+		return err
+	}
+
+	printRoutesDiff(out, before, after)
+
+	return nil
+}
+
+func routesByUrl(connections []backends.ConnectionConfig) map[string]backends.ConnectionConfig {
+	byUrl := make(map[string]backends.ConnectionConfig, len(connections))
+
+	for i := range connections {
+		byUrl[connections[i].Url] = connections[i]
+	}
+
+	return byUrl
+}
+
+func routeState(connection backends.ConnectionConfig) string {
+	if connection.Invalid != "" {
+		return "invalid"
+	}
+
+	if connection.Disabled {
+		return "disabled"
+	}
+
+	return "enabled"
+}
+
+func printRoutes(out io.Writer, connections []backends.ConnectionConfig) {
+	writer := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+
+	for _, connection := range connections {
+		if connection.Invalid != "" {
+			fmt.Fprintf(writer, "%s\t%s\t%s\n", connection.Url, routeState(connection), connection.Invalid)
+			continue
+		}
+
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n", connection.Url, routeState(connection), connection.Owner, connection.Description)
+	}
+
+	writer.Flush()
+}
+
+// printRoutesDiff prints added routes with a '+', removed ones with a '-' and toggled ones with a '~'.
+func printRoutesDiff(out io.Writer, before []backends.ConnectionConfig, after []backends.ConnectionConfig) {
+	beforeByUrl := routesByUrl(before)
+	afterByUrl := routesByUrl(after)
+
+	urls := make([]string, 0, len(beforeByUrl) + len(afterByUrl))
+
+	for url := range beforeByUrl {
+		urls = append(urls, url)
+	}
+
+	for url := range afterByUrl {
+		if _, ok := beforeByUrl[url]; !ok {
+			urls = append(urls, url)
+		}
+	}
+
+	sort.Strings(urls)
+
+	changes := 0
+
+	for _, url := range urls {
+		old, existed := beforeByUrl[url]
+		current, exists := afterByUrl[url]
+
+		switch {
+		case !existed:
+			fmt.Fprintf(out, "+ %s (%s)\n", url, routeState(current))
+		case !exists:
+			fmt.Fprintf(out, "- %s (%s)\n", url, routeState(old))
+		case old.Disabled != current.Disabled:
+			fmt.Fprintf(out, "~ %s (%s -> %s)\n", url, routeState(old), routeState(current))
+		default:
+			continue
+		}
+
+		changes++
+	}
+
+	if changes == 0 {
+		fmt.Fprintln(out, "No changes")
+	}
+}
+
+func runRoutes() {
+	if err := RunRoutesCommand(os.Args[2:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
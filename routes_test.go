@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"github.com/brandnetworks/tcpproxy/backends"
+	"github.com/stretchr/testify/assert"
+)
+
+// Stores the raw configurations like the dynamodb backend, the ones which don't parse are listed as invalid
+type fakeManageable struct {
+	configurations []string
+	disabled       map[string]bool
+}
+
+func (f *fakeManageable) CreateProxyConfiguration(configuration string) error {
+	f.configurations = append(f.configurations, configuration)
+	return nil
+}
+
+func (f *fakeManageable) DeleteProxyConfiguration(configuration string) error {
+	for i := range f.configurations {
+		if f.configurations[i] == configuration {
+			f.configurations = append(f.configurations[:i], f.configurations[i + 1:]...)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("No configuration %s", configuration)
+}
+
+func (f *fakeManageable) SetProxyConfigurationEnabled(configuration string, enabled bool) error {
+	f.disabled[configuration] = !enabled
+	return nil
+}
+
+func (f *fakeManageable) GetProxyConfigurations() ([]backends.ConnectionConfig, error) {
+	return f.ListProxyConfigurations()
+}
+
+func (f *fakeManageable) ListProxyConfigurations() ([]backends.ConnectionConfig, error) {
+	connections := make([]backends.ConnectionConfig, len(f.configurations))
+
+	for i, configuration := range f.configurations {
+		connection, err := backends.ParseConnection(configuration)
+
+		if err != nil {
+			connections[i] = backends.ConnectionConfig{Url: configuration, Invalid: err.Error()}
+			continue
+		}
+
+		connection.Disabled = f.disabled[configuration]
+		connections[i] = *connection
+	}
+
+	return connections, nil
+}
+
+func createFakeManageable(configurations ...string) *fakeManageable {
+	return &fakeManageable{configurations: configurations, disabled: make(map[string]bool)}
+}
+
+func TestAddRoute(t *testing.T) {
+	manageable := createFakeManageable("8001:example.com:5431")
+	out := &bytes.Buffer{}
+
+	assert.Nil(t, ManageRoutes(manageable, "add", []string{"8002:example.com:5432"}, out))
+	assert.Equal(t, "+ 8002:example.com:5432 (enabled)\n", out.String())
+	assert.Equal(t, []string{"8001:example.com:5431", "8002:example.com:5432"}, manageable.configurations)
+
+	assert.NotNil(t, ManageRoutes(manageable, "add", []string{"8002:example.com:5432"}, out))
+	assert.NotNil(t, ManageRoutes(manageable, "add", []string{"8003:example.com"}, out))
+	assert.Len(t, manageable.configurations, 2)
+}
+
+func TestListRoutes(t *testing.T) {
+	manageable := createFakeManageable("8001:example.com:5431", "8002:example.com", "8003:example.com:5433")
+	manageable.disabled["8003:example.com:5433"] = true
+	out := &bytes.Buffer{}
+
+	// The invalid configuration doesn't keep the others from being listed
+	assert.Nil(t, ManageRoutes(manageable, "list", nil, out))
+	assert.Contains(t, out.String(), "8001:example.com:5431  enabled")
+	assert.Contains(t, out.String(), "8002:example.com       invalid   A connection must have three parts")
+	assert.Contains(t, out.String(), "8003:example.com:5433  disabled")
+}
+
+func TestRemoveRoute(t *testing.T) {
+	manageable := createFakeManageable("8001:example.com:5431", "8002:example.com")
+	out := &bytes.Buffer{}
+
+	assert.Nil(t, ManageRoutes(manageable, "remove", []string{"8001:example.com:5431"}, out))
+	assert.Equal(t, "- 8001:example.com:5431 (enabled)\n", out.String())
+
+	// Removed by its raw key although it doesn't parse
+	out.Reset()
+	assert.Nil(t, ManageRoutes(manageable, "remove", []string{"8002:example.com"}, out))
+	assert.Equal(t, "- 8002:example.com (invalid)\n", out.String())
+	assert.Empty(t, manageable.configurations)
+
+	assert.NotNil(t, ManageRoutes(manageable, "remove", []string{"8002:example.com"}, out))
+}
@@ -0,0 +1,185 @@
+package web
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+type Role int
+
+const (
+	RoleNone Role = iota
+	RoleRead
+	RoleAdmin
+)
+
+func ParseRole(role string) (Role, error) {
+	switch strings.ToLower(role) {
+	case "read":
+		return RoleRead, nil
+	case "admin":
+		return RoleAdmin, nil
+	default:
+		return RoleNone, fmt.Errorf("Unrecognised role '%s', expected read or admin", role)
+	}
+}
+
+// Auth maps bearer tokens and client certificate common names to roles.
+// Without any of them configured read access is anonymous and admin access is refused.
+type Auth struct {
+	// Only token hashes are kept, so lookups don't compare the secrets themselves
+	tokens  map[[sha256.Size]byte]Role
+	clients map[string]Role
+
+	// Lets load balancers health check /status without credentials
+	AnonymousStatus bool
+}
+
+func CreateAuth(anonymousStatus bool) *Auth {
+	return &Auth{
+		tokens:          make(map[[sha256.Size]byte]Role),
+		clients:         make(map[string]Role),
+		AnonymousStatus: anonymousStatus,
+	}
+}
+
+func (a *Auth) AddToken(token string, role Role) {
+	a.tokens[sha256.Sum256([]byte(token))] = role
+}
+
+// AddClient grants a role to client certificates with the given common name.
+func (a *Auth) AddClient(commonName string, role Role) {
+	a.clients[commonName] = role
+}
+
+// LoadTokens reads a file of "<role> <token>" lines, blank lines and lines starting with '#' are ignored.
+func (a *Auth) LoadTokens(path string) error {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: expected '<role> <token>'", path, lineNumber)
+		}
+
+		role, err := ParseRole(fields[0])
+
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, lineNumber, err)
+		}
+
+		a.AddToken(fields[1], role)
+	}
+
+	return scanner.Err()
+}
+
+func (a *Auth) enabled() bool {
+	return a != nil && (len(a.tokens) > 0 || len(a.clients) > 0)
+}
+
+func (a *Auth) role(r *http.Request) Role {
+	if !a.enabled() {
+		return RoleRead
+	}
+
+	role := RoleNone
+
+	if token := bearerToken(r); token != "" {
+		role = a.tokens[sha256.Sum256([]byte(token))]
+	}
+
+	// Only chains verified against the client CA count, not whatever certificate was presented
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		if clientRole := a.clients[r.TLS.VerifiedChains[0][0].Subject.CommonName]; clientRole > role {
+			role = clientRole
+		}
+	}
+
+	return role
+}
+
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+
+	return ""
+}
+
+// Require wraps a handler so it only runs for requests granted at least the given role.
+func (a *Auth) Require(role Role, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		granted := a.role(r)
+
+		if granted >= role {
+			handler(w, r)
+			return
+		}
+
+		if !a.enabled() {
+			writeError(w, http.StatusForbidden, fmt.Errorf("Admin endpoints need status tokens or client certificates to be configured"))
+			return
+		}
+
+		if granted == RoleNone {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="tcpproxy"`)
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("Authentication required"))
+			return
+		}
+
+		writeError(w, http.StatusForbidden, fmt.Errorf("Insufficient role"))
+	}
+}
+
+// ServerTLSConfig asks clients for a certificate signed by the CA in clientCAFile,
+// clients without one can still authenticate with a bearer token.
+func ServerTLSConfig(clientCAFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if clientCAFile == "" {
+		return config, nil
+	}
+
+	pem, err := ioutil.ReadFile(clientCAFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	config.ClientCAs = x509.NewCertPool()
+
+	if !config.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates found in %s", clientCAFile)
+	}
+
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+
+	return config, nil
+}
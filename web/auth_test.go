@@ -0,0 +1,91 @@
+package web
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func statusCode(t *testing.T, auth *Auth, path string, configure func(r *http.Request)) int {
+	mux := InitialiseEndpoints(slog.New(slog.DiscardHandler), "test", testProxy(t, &memoryBackend{}), auth)
+	request := httptest.NewRequest("GET", path, nil)
+	configure(request)
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, request)
+	return recorder.Code
+}
+
+func withToken(token string) func(r *http.Request) {
+	return func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer " + token)
+	}
+}
+
+func anonymous(r *http.Request) {}
+
+func TestBearerTokenRoles(t *testing.T) {
+	auth := CreateAuth(true)
+	auth.AddToken("read-token", RoleRead)
+	auth.AddToken("admin-token", RoleAdmin)
+
+	assert.Equal(t, http.StatusOK, statusCode(t, auth, "/status", anonymous))
+	assert.Equal(t, http.StatusUnauthorized, statusCode(t, auth, "/connections", anonymous))
+	assert.Equal(t, http.StatusUnauthorized, statusCode(t, auth, "/connections", withToken("wrong-token")))
+	assert.Equal(t, http.StatusOK, statusCode(t, auth, "/connections", withToken("read-token")))
+	assert.Equal(t, http.StatusForbidden, statusCode(t, auth, "/routes/1:a:2", withToken("read-token")))
+	assert.Equal(t, http.StatusMethodNotAllowed, statusCode(t, auth, "/routes/1:a:2", withToken("admin-token")))
+
+	auth.AnonymousStatus = false
+	assert.Equal(t, http.StatusUnauthorized, statusCode(t, auth, "/status", anonymous))
+	assert.Equal(t, http.StatusOK, statusCode(t, auth, "/status", withToken("read-token")))
+}
+
+func TestWithoutAuth(t *testing.T) {
+	assert.Equal(t, http.StatusOK, statusCode(t, nil, "/status", anonymous))
+	assert.Equal(t, http.StatusOK, statusCode(t, nil, "/connections", anonymous))
+	assert.Equal(t, http.StatusForbidden, statusCode(t, nil, "/routes/1:a:2", anonymous))
+}
+
+func TestClientCertificateRoles(t *testing.T) {
+	auth := CreateAuth(true)
+	auth.AddClient("deploy-tool", RoleAdmin)
+
+	withCertificate := func(commonName string) func(r *http.Request) {
+		return func(r *http.Request) {
+			certificate := &x509.Certificate{Subject: pkix.Name{CommonName: commonName}}
+			r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{certificate}}}
+		}
+	}
+
+	assert.Equal(t, http.StatusMethodNotAllowed, statusCode(t, auth, "/routes/1:a:2", withCertificate("deploy-tool")))
+	assert.Equal(t, http.StatusUnauthorized, statusCode(t, auth, "/routes/1:a:2", withCertificate("someone-else")))
+
+	// A presented but unverified certificate grants nothing
+	unverified := func(r *http.Request) {
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "deploy-tool"}}}}
+	}
+	assert.Equal(t, http.StatusUnauthorized, statusCode(t, auth, "/connections", unverified))
+}
+
+func TestLoadTokens(t *testing.T) {
+	file, _ := ioutil.TempFile("", "tokens")
+	defer os.Remove(file.Name())
+
+	file.WriteString("# CI runners\nadmin admin-token\n\nread read-token\n")
+	file.Close()
+
+	auth := CreateAuth(true)
+	assert.Nil(t, auth.LoadTokens(file.Name()))
+	assert.Equal(t, http.StatusOK, statusCode(t, auth, "/connections", withToken("read-token")))
+	assert.Equal(t, http.StatusMethodNotAllowed, statusCode(t, auth, "/routes/1:a:2", withToken("admin-token")))
+
+	ioutil.WriteFile(file.Name(), []byte("owner admin-token\n"), 0600)
+	assert.NotNil(t, CreateAuth(true).LoadTokens(file.Name()))
+}
@@ -2,45 +2,76 @@ package web
 import (
 	"net/http"
 	"fmt"
+	"github.com/brandnetworks/tcpproxy/backends"
 	"github.com/brandnetworks/tcpproxy/proxy"
-	"log"
+	"log/slog"
 	"encoding/json"
 )
 
-func InitialiseEndpoints(logLevel int, proxyName string, connectionManager *proxy.Proxy) (*http.ServeMux) {
+func InitialiseEndpoints(logger *slog.Logger, proxyName string, connectionManager *proxy.Proxy, auth *Auth) (*http.ServeMux) {
 
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/status", func(w http.ResponseWriter, _ *http.Request) {
+	status := func(w http.ResponseWriter, _ *http.Request) {
+		// Load balancers stop sending clients once the proxy starts shutting down
+		if connectionManager.Draining() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "Shutting down")
+			return
+		}
+
 		fmt.Fprintf(w, "OK")
-	})
+	}
 
-	mux.HandleFunc("/connections", func(w http.ResponseWriter, _ *http.Request) {
-		if logLevel > 2 {
-			log.Println("liveProxyConfigurations", connectionManager.LiveConnections)
-		}
+	if auth == nil || auth.AnonymousStatus {
+		mux.HandleFunc("/status", status)
+	} else {
+		mux.HandleFunc("/status", auth.Require(RoleRead, status))
+	}
 
+	mux.HandleFunc("/connections", auth.Require(RoleRead, func(w http.ResponseWriter, _ *http.Request) {
 		connectionsMap := make(map[string]interface{})
 
 		if proxyName != "" {
 			connectionsMap["name"] = proxyName
 		}
 
-		if connectionManager.LiveConnections == nil || len(connectionManager.LiveConnections) == 0 {
+		// A snapshot, the poller replaces the live connections while this runs
+		routes := connectionManager.Routes()
+
+		if len(routes) == 0 {
 			connectionsMap["error"] = "No connections!"
 		} else {
 			connections := make([]string, 0)
 
-			for url, _ := range connectionManager.LiveConnections {
-				connections = append(connections, url)
+			for _, route := range routes {
+				connections = append(connections, route.Url)
 			}
 
 			connectionsMap["connections"] = connections
 		}
 
+		// Running from the snapshot, or the last routes of the sources, while the backend is unavailable
+		if stale, since := connectionManager.Stale(); stale {
+			connectionsMap["stale"] = true
+			connectionsMap["snapshot_time"] = since
+		}
+
+		if held := connectionManager.Held(); held != nil {
+			connectionsMap["held"] = held
+		}
+
 		out, _ := json.Marshal(connectionsMap)
 		fmt.Fprintln(w, string(out))
-	})
+	}))
+
+	mux.HandleFunc("/events", auth.Require(RoleRead, streamEvents(logger, connectionManager)))
+
+	// Routes can only be changed through backends that store them
+	if backend, ok := connectionManager.Backend.(backends.ReadWrite); ok {
+		mux.HandleFunc("/routes", auth.Require(RoleAdmin, createRoute(logger, connectionManager, backend)))
+		mux.HandleFunc("/routes/", auth.Require(RoleAdmin, deleteRoute(logger, connectionManager, backend)))
+	}
 
 	return mux
 }
\ No newline at end of file
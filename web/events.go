@@ -0,0 +1,55 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"github.com/brandnetworks/tcpproxy/proxy"
+)
+
+// How many events a slow client can fall behind before the next ones are dropped
+const eventBuffer = 64
+
+// streamEvents sends the events of the proxy as Server-Sent Events until the client goes away.
+func streamEvents(logger *slog.Logger, connectionManager *proxy.Proxy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+
+		if !ok {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("Streaming is not supported"))
+			return
+		}
+
+		events := make(chan proxy.Event, eventBuffer)
+
+		unsubscribe := connectionManager.Subscribe(func(event proxy.Event) {
+			select {
+			case events <- event:
+			default:
+				logger.Debug("Dropping event for slow client", "client", r.RemoteAddr, "event", event.Type)
+			}
+		})
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			// Lets the status server shut down rather than wait for the clients to go away
+			case <-connectionManager.Stopping():
+				return
+			case event := <-events:
+				out, _ := json.Marshal(event)
+
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, out)
+				flusher.Flush()
+			}
+		}
+	}
+}
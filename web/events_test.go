@@ -0,0 +1,128 @@
+package web
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"github.com/brandnetworks/tcpproxy/proxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamEvents(t *testing.T) {
+	connectionManager := testProxy(t, &memoryBackend{})
+	server := httptest.NewServer(InitialiseEndpoints(slog.New(slog.DiscardHandler), "test", connectionManager, adminAuth()))
+	defer server.Close()
+
+	response, err := http.Get(server.URL + "/events")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+
+	response, err = adminRequest("GET", server.URL + "/events", "")
+	assert.Nil(t, err)
+	defer response.Body.Close()
+
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "text/event-stream", response.Header.Get("Content-Type"))
+
+	// The headers are flushed once the handler has subscribed
+	connectionManager.Events.Publish(proxy.Event{Type: proxy.RouteCreated, Route: "18002:localhost:18003"})
+
+	reader := bufio.NewReader(response.Body)
+
+	event, _ := reader.ReadString('\n')
+	data, _ := reader.ReadString('\n')
+
+	assert.Equal(t, "event: route_created\n", event)
+	assert.True(t, strings.HasPrefix(data, "data: {"))
+	assert.Contains(t, data, `"route":"18002:localhost:18003"`)
+}
+
+func TestShutdown(t *testing.T) {
+	connectionManager := testProxy(t, &memoryBackend{})
+	server := httptest.NewServer(InitialiseEndpoints(slog.New(slog.DiscardHandler), "test", connectionManager, nil))
+	defer server.Close()
+
+	response, err := adminRequest("GET", server.URL + "/events", "")
+	assert.Nil(t, err)
+	defer response.Body.Close()
+
+	assert.Nil(t, connectionManager.Shutdown(context.Background()))
+
+	// The stream ends rather than holding up the shutdown of the server
+	_, err = ioutil.ReadAll(response.Body)
+	assert.Nil(t, err)
+
+	response, err = http.Get(server.URL + "/status")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, response.StatusCode)
+}
+
+func TestShutdownDelay(t *testing.T) {
+	free, _ := net.Listen("tcp", "127.0.0.1:0")
+	_, port, _ := net.SplitHostPort(free.Addr().String())
+	free.Close()
+
+	proxyServer, err := proxy.New(
+		proxy.WithBackend(&memoryBackend{configurations: []string{port + ":127.0.0.1:1"}}),
+		proxy.WithLogger(slog.New(slog.DiscardHandler)),
+		proxy.WithShutdownDelay(500 * time.Millisecond),
+	)
+	assert.Nil(t, err)
+	assert.Nil(t, proxyServer.Start(context.Background()))
+
+	server := httptest.NewServer(InitialiseEndpoints(slog.New(slog.DiscardHandler), "test", proxyServer.Proxy(), nil))
+	defer server.Close()
+
+	accepts := func() bool {
+		conn, err := net.DialTimeout("tcp", "127.0.0.1:" + port, time.Second)
+
+		if err != nil {
+			return false
+		}
+
+		conn.Close()
+		return true
+	}
+
+	for i := 0; i < 100 && !accepts(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	done := make(chan error, 1)
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+		defer cancel()
+
+		done <- proxyServer.Shutdown(ctx)
+	}()
+
+	status := func() int {
+		response, err := http.Get(server.URL + "/status")
+
+		if err != nil {
+			return 0
+		}
+
+		response.Body.Close()
+		return response.StatusCode
+	}
+
+	for i := 0; i < 100 && status() != http.StatusServiceUnavailable; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Load balancers see the proxy unhealthy while clients are still accepted
+	assert.Equal(t, http.StatusServiceUnavailable, status())
+	assert.True(t, accepts())
+
+	assert.Nil(t, <-done)
+	assert.False(t, accepts())
+}
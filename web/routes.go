@@ -0,0 +1,156 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"github.com/brandnetworks/tcpproxy/backends"
+	"github.com/brandnetworks/tcpproxy/proxy"
+)
+
+type routeRequest struct {
+	Configuration string `json:"configuration"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	out, _ := json.Marshal(value)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintln(w, string(out))
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// applyRoutes picks up a change straight away rather than on the next poll. The
+// change is already persisted when this fails, so it is still applied later.
+func applyRoutes(logger *slog.Logger, w http.ResponseWriter, connectionManager *proxy.Proxy, status int, configuration string) {
+	if err := connectionManager.UpdateConnections(); err != nil {
+		logger.Error("Error applying route change", "route", configuration, "error", err)
+		writeJSON(w, http.StatusAccepted, map[string]string{
+			"configuration": configuration,
+			"error":         fmt.Sprintf("Saved, but not applied yet: %v", err),
+		})
+		return
+	}
+
+	if held := connectionManager.Held(); held != nil {
+		writeJSON(w, http.StatusAccepted, map[string]string{
+			"configuration": configuration,
+			"error":         fmt.Sprintf("Saved, but held back until %d polls confirm it", connectionManager.Guard.Polls),
+		})
+		return
+	}
+
+	writeJSON(w, status, map[string]string{"configuration": configuration})
+}
+
+func storedRoutes(backend backends.ReadWrite) ([]backends.ConnectionConfig, error) {
+	if manageable, ok := backend.(backends.Manageable); ok {
+		return manageable.ListProxyConfigurations()
+	}
+
+	return backend.GetProxyConfigurations()
+}
+
+// routeExists looks the configuration up among the stored ones, as the backends write without checking
+func routeExists(backend backends.ReadWrite, configuration string) (bool, error) {
+	routes, err := storedRoutes(backend)
+
+	if err != nil {
+		return false, err
+	}
+
+	for i := range routes {
+		if routes[i].Url == configuration {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func createRoute(logger *slog.Logger, connectionManager *proxy.Proxy, backend backends.ReadWrite) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s not allowed", r.Method))
+			return
+		}
+
+		var request routeRequest
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("Invalid request body: %v", err))
+			return
+		}
+
+		connection, err := backends.ParseConnection(request.Configuration)
+
+		if err == nil {
+			err = connection.Validate()
+		}
+
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		exists, err := routeExists(backend, request.Configuration)
+
+		if err != nil {
+			writeError(w, http.StatusBadGateway, err)
+			return
+		}
+
+		// Creating it again would overwrite the attributes stored with it
+		if exists {
+			writeError(w, http.StatusConflict, fmt.Errorf("Route %s already exists", request.Configuration))
+			return
+		}
+
+		if err := backend.CreateProxyConfiguration(request.Configuration); err != nil {
+			logger.Error("Error creating route", "route", request.Configuration, "error", err)
+			writeError(w, http.StatusBadGateway, err)
+			return
+		}
+
+		applyRoutes(logger, w, connectionManager, http.StatusCreated, request.Configuration)
+	}
+}
+
+func deleteRoute(logger *slog.Logger, connectionManager *proxy.Proxy, backend backends.ReadWrite) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" {
+			w.Header().Set("Allow", "DELETE")
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s not allowed", r.Method))
+			return
+		}
+
+		configuration := strings.TrimPrefix(r.URL.Path, "/routes/")
+
+		found, err := routeExists(backend, configuration)
+
+		if err != nil {
+			writeError(w, http.StatusBadGateway, err)
+			return
+		}
+
+		if !found {
+			writeError(w, http.StatusNotFound, fmt.Errorf("No route %s", configuration))
+			return
+		}
+
+		if err := backend.DeleteProxyConfiguration(configuration); err != nil {
+			logger.Error("Error deleting route", "route", configuration, "error", err)
+			writeError(w, http.StatusBadGateway, err)
+			return
+		}
+
+		applyRoutes(logger, w, connectionManager, http.StatusOK, configuration)
+	}
+}
@@ -0,0 +1,247 @@
+package web
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"github.com/brandnetworks/tcpproxy/backends"
+	"github.com/brandnetworks/tcpproxy/proxy"
+	"github.com/stretchr/testify/assert"
+)
+
+type memoryBackend struct {
+	sync.Mutex
+	configurations []string
+}
+
+func (b *memoryBackend) CreateProxyConfiguration(proxy_configuration string) error {
+	b.Lock()
+	defer b.Unlock()
+
+	b.configurations = append(b.configurations, proxy_configuration)
+	return nil
+}
+
+func (b *memoryBackend) DeleteProxyConfiguration(proxy_configuration string) error {
+	b.Lock()
+	defer b.Unlock()
+
+	for i := range b.configurations {
+		if b.configurations[i] == proxy_configuration {
+			b.configurations = append(b.configurations[:i], b.configurations[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (b *memoryBackend) GetProxyConfigurations() ([]backends.ConnectionConfig, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	connections := make([]backends.ConnectionConfig, 0)
+
+	for _, configuration := range b.configurations {
+		connection, err := backends.ParseConnection(configuration)
+		if err != nil {
+			return nil, err
+		}
+		connections = append(connections, *connection)
+	}
+
+	return connections, nil
+}
+
+func (b *memoryBackend) IsPollable() bool {
+	return true
+}
+
+func testProxy(t *testing.T, backend backends.ReadOnly) *proxy.Proxy {
+	connectionManager := proxy.CreateProxy(backend)
+	quit := make(chan struct{})
+
+	t.Cleanup(func() {
+		close(quit)
+	})
+
+	// Nothing listens in these tests, the updates only need consuming until the test ends
+	go func() {
+		for {
+			select {
+			case <-connectionManager.CreateChannel:
+			case <-connectionManager.KillChannel:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	return connectionManager
+}
+
+func routeUrls(connectionManager *proxy.Proxy) []string {
+	urls := make([]string, 0)
+
+	for _, route := range connectionManager.Routes() {
+		urls = append(urls, route.Url)
+	}
+
+	return urls
+}
+
+func adminAuth() *Auth {
+	auth := CreateAuth(true)
+	auth.AddToken("admin-token", RoleAdmin)
+	return auth
+}
+
+func adminRequest(method string, url string, body string) (*http.Response, error) {
+	request, _ := http.NewRequest(method, url, strings.NewReader(body))
+	request.Header.Set("Authorization", "Bearer admin-token")
+	return http.DefaultClient.Do(request)
+}
+
+func TestCreateAndDeleteRoute(t *testing.T) {
+	backend := &memoryBackend{}
+	connectionManager := testProxy(t, backend)
+	server := httptest.NewServer(InitialiseEndpoints(slog.New(slog.DiscardHandler), "test", connectionManager, adminAuth()))
+	defer server.Close()
+
+	response, err := adminRequest("POST", server.URL + "/routes", `{"configuration": "18002:localhost:18003"}`)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, response.StatusCode)
+	assert.Equal(t, []string{"18002:localhost:18003"}, backend.configurations)
+	assert.Equal(t, []string{"18002:localhost:18003"}, routeUrls(connectionManager))
+
+	response, err = adminRequest("DELETE", server.URL + "/routes/18002:localhost:18003", "")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Empty(t, backend.configurations)
+	assert.Empty(t, connectionManager.Routes())
+}
+
+func TestCreateExistingRoute(t *testing.T) {
+	backend := &memoryBackend{configurations: []string{"18002:localhost:18003"}}
+	server := httptest.NewServer(InitialiseEndpoints(slog.New(slog.DiscardHandler), "test", testProxy(t, backend), adminAuth()))
+	defer server.Close()
+
+	response, err := adminRequest("POST", server.URL + "/routes", `{"configuration": "18002:localhost:18003"}`)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusConflict, response.StatusCode)
+	assert.Equal(t, []string{"18002:localhost:18003"}, backend.configurations)
+}
+
+func TestRejectInvalidRoute(t *testing.T) {
+	backend := &memoryBackend{}
+	server := httptest.NewServer(InitialiseEndpoints(slog.New(slog.DiscardHandler), "test", testProxy(t, backend), adminAuth()))
+	defer server.Close()
+
+	response, err := adminRequest("POST", server.URL + "/routes", `{"configuration": "18002:localhost"}`)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+	assert.Empty(t, backend.configurations)
+
+	response, err = adminRequest("DELETE", server.URL + "/routes/18004:localhost:18005", "")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+}
+
+func TestUpgrade(t *testing.T) {
+	upgrades := 0
+	upgrade := func() (int, error) {
+		upgrades++
+
+		if upgrades > 1 {
+			return 0, fmt.Errorf("Already upgraded")
+		}
+
+		return 1234, nil
+	}
+
+	server := httptest.NewServer(adminAuth().Require(RoleAdmin, Upgrade(slog.New(slog.DiscardHandler), upgrade)))
+	defer server.Close()
+
+	response, err := adminRequest("GET", server.URL, "")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusMethodNotAllowed, response.StatusCode)
+
+	response, err = http.Post(server.URL, "application/json", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+	assert.Equal(t, 0, upgrades)
+
+	response, err = adminRequest("POST", server.URL, "")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusAccepted, response.StatusCode)
+
+	body, _ := ioutil.ReadAll(response.Body)
+	assert.JSONEq(t, `{"pid": 1234}`, string(body))
+
+	response, err = adminRequest("POST", server.URL, "")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusInternalServerError, response.StatusCode)
+}
+
+// Meant for go test -race, the routes are read over HTTP while polls and the admin endpoints change them.
+func TestConcurrentConnections(t *testing.T) {
+	backend := &memoryBackend{}
+	connectionManager := testProxy(t, backend)
+	server := httptest.NewServer(InitialiseEndpoints(slog.New(slog.DiscardHandler), "test", connectionManager, adminAuth()))
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	running := func(work func()) {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				work()
+			}
+		}()
+	}
+
+	running(func() {
+		connectionManager.UpdateConnections()
+	})
+
+	running(func() {
+		adminRequest("POST", server.URL + "/routes", `{"configuration": "18002:localhost:18003"}`)
+		adminRequest("DELETE", server.URL + "/routes/18002:localhost:18003", "")
+	})
+
+	for i := 0; i < 2; i++ {
+		running(func() {
+			response, err := adminRequest("GET", server.URL + "/connections", "")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			body, _ := ioutil.ReadAll(response.Body)
+			response.Body.Close()
+
+			assert.Equal(t, http.StatusOK, response.StatusCode)
+			assert.Contains(t, string(body), `"name":"test"`)
+		})
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+}
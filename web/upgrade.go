@@ -0,0 +1,30 @@
+package web
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// Upgrade returns a handler starting an upgrade to a new process, which upgrade does and returns the pid of.
+// Admin clients call it once the new binary is in place, e.g. from the deploy tooling.
+func Upgrade(logger *slog.Logger, upgrade func() (int, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s not allowed", r.Method))
+			return
+		}
+
+		pid, err := upgrade()
+
+		if err != nil {
+			logger.Error("Error upgrading", "error", err)
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		// This process drains from now on, the new one answers the next requests
+		writeJSON(w, http.StatusAccepted, map[string]int{"pid": pid})
+	}
+}